@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"strings"
+)
+
+const defaultPassword = "password"
+
+const passwordHashSetting = "password_hash"
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// checkPassword compares password to the login password in constant time
+func checkPassword(password string) bool {
+	password_hash := settings().PasswordHash
+	if password_hash == nil {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(defaultPassword)) == 1
+	}
+	return bcrypt.CompareHashAndPassword(password_hash, []byte(password)) == nil
+}
+
+func isDefaultPassword() bool {
+	return settings().PasswordHash == nil || checkPassword(defaultPassword)
+}
+
+// loadPasswordHash hashes password if not empty, else returns the hash
+// stored in database by the passwd command, nil if there is none
+func loadPasswordHash(password string) ([]byte, error) {
+	if password != "" {
+		return hashPassword(password)
+	}
+	hash, err := getSetting(passwordHashSetting)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hash), nil
+}
+
+// loadPassword sets the login password hash, see loadPasswordHash
+func loadPassword(password string) error {
+	password_hash, err := loadPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	changeSettings(func(s *Settings) { s.PasswordHash = password_hash })
+	return nil
+}
+
+// storePassword saves password hash in database
+func storePassword(password string) error {
+	if password == "" {
+		return errors.New("password can't be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return setSetting(passwordHashSetting, string(hash))
+}
+
+// readNewPassword prompts new password twice without echo on a terminal,
+// else reads it on the first line of stdin
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(password, confirm) != 1 {
+		return "", errors.New("passwords don't match")
+	}
+	return string(password), nil
+}
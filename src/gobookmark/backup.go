@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattes/migrate/migrate"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backup archives are gzipped tar files of a database snapshot and its
+// manifest, the index is rebuilt on restore
+const (
+	backupDatabaseName = "gobookmark.db"
+	backupManifestName = "manifest.json"
+	backupPrefix       = "gobookmark-"
+	backupExtension    = ".tar.gz"
+)
+
+type backupManifest struct {
+	CreateDate    time.Time `json:"createdate"`
+	SchemaVersion uint64    `json:"schema_version"`
+}
+
+var (
+	// backupLock serializes snapshots, backupConnection is only used
+	// while it's held
+	backupLock       sync.Mutex
+	backupConnection *sqlite3.SQLiteConn
+)
+
+func init() {
+	// database/sql hides driver connections, the backup API needs them
+	sql.Register("sqlite3_backup", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			backupConnection = conn
+			return nil
+		},
+	})
+}
+
+// openBackupConnection opens filename with a single connection, which is
+// returned for the backup API
+func openBackupConnection(filename string) (*sql.DB, *sqlite3.SQLiteConn, error) {
+	db, err := sql.Open("sqlite3_backup", filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+	backupConnection = nil
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, backupConnection, nil
+}
+
+// snapshotDatabase copies source database into dest with SQLite online
+// backup API, source can be written meanwhile
+func snapshotDatabase(source string, dest string) error {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	source_db, source_conn, err := openBackupConnection(source)
+	if err != nil {
+		return err
+	}
+	defer source_db.Close()
+	dest_db, dest_conn, err := openBackupConnection(dest)
+	if err != nil {
+		return err
+	}
+	defer dest_db.Close()
+
+	backup, err := dest_conn.Backup("main", source_conn, "main")
+	if err != nil {
+		return err
+	}
+	done, err := backup.Step(-1)
+	if err == nil && !done {
+		err = errors.New("database backup isn't complete")
+	}
+	if err_finish := backup.Finish(); err == nil {
+		err = err_finish
+	}
+	return err
+}
+
+func addTarFile(writer *tar.Writer, name string, content io.Reader, size int64) error {
+	err := writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// writeBackup writes an archive of db_filename database, the archive is
+// created next to archive_filename then renamed, so it's never partial
+func writeBackup(archive_filename string, db_filename string) error {
+	if _, err := os.Stat(archive_filename); err == nil {
+		return fmt.Errorf("%s already exists", archive_filename)
+	}
+	if _, err := os.Stat(db_filename); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(archive_filename), ".gobookmark-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot_filename := filepath.Join(dir, backupDatabaseName)
+	if err := snapshotDatabase(db_filename, snapshot_filename); err != nil {
+		return err
+	}
+	version, err := migrate.Version("sqlite3://"+snapshot_filename, "migrations/sqlite3")
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(backupManifest{CreateDate: time.Now(), SchemaVersion: version})
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := os.Open(snapshot_filename)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	info, err := snapshot.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp_filename := filepath.Join(dir, filepath.Base(archive_filename))
+	f, err := os.OpenFile(tmp_filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzip_writer := gzip.NewWriter(f)
+	tar_writer := tar.NewWriter(gzip_writer)
+	if err := addTarFile(tar_writer, backupManifestName, bytes.NewReader(manifest), int64(len(manifest))); err != nil {
+		return err
+	}
+	if err := addTarFile(tar_writer, backupDatabaseName, snapshot, info.Size()); err != nil {
+		return err
+	}
+	if err := tar_writer.Close(); err != nil {
+		return err
+	}
+	if err := gzip_writer.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_filename, archive_filename)
+}
+
+// readBackup extracts the database of archive_filename to db_filename and
+// returns the archive manifest
+func readBackup(archive_filename string, db_filename string) (*backupManifest, error) {
+	f, err := os.Open(archive_filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzip_reader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a backup archive : %v", archive_filename, err)
+	}
+	defer gzip_reader.Close()
+
+	var manifest *backupManifest
+	database_found := false
+	tar_reader := tar.NewReader(gzip_reader)
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't a backup archive : %v", archive_filename, err)
+		}
+		switch header.Name {
+		case backupManifestName:
+			manifest = new(backupManifest)
+			if err := json.NewDecoder(tar_reader).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%s manifest is invalid : %v", archive_filename, err)
+			}
+		case backupDatabaseName:
+			db_file, err := os.OpenFile(db_filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(db_file, tar_reader)
+			if err_close := db_file.Close(); err == nil {
+				err = err_close
+			}
+			if err != nil {
+				return nil, err
+			}
+			database_found = true
+		}
+	}
+	if manifest == nil || !database_found {
+		return nil, fmt.Errorf("%s isn't a backup archive : database or manifest missing", archive_filename)
+	}
+	return manifest, nil
+}
+
+// checkDatabaseIntegrity runs SQLite integrity check on filename
+func checkDatabaseIntegrity(filename string) error {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("database integrity check failed : %s", result)
+	}
+	return nil
+}
+
+// restoreBackup replaces db_filename database by the one of
+// archive_filename and rebuilds index_filename index, unless it's empty.
+// The web server must be stopped. DB is left opened on the restored database.
+func restoreBackup(archive_filename string, db_filename string, index_filename string) error {
+	restore_filename := db_filename + ".restore"
+	defer os.Remove(restore_filename)
+	manifest, err := readBackup(archive_filename, restore_filename)
+	if err != nil {
+		return err
+	}
+	latest, err := latestMigrationVersion("sqlite3://" + db_filename)
+	if err != nil {
+		return err
+	}
+	if manifest.SchemaVersion > latest {
+		return fmt.Errorf(
+			"%s database schema version is %d, this gobookmark supports up to %d",
+			archive_filename, manifest.SchemaVersion, latest,
+		)
+	}
+	if err := checkDatabaseIntegrity(restore_filename); err != nil {
+		return err
+	}
+
+	if DB != nil {
+		DB.Close()
+	}
+	os.Remove(db_filename + "-journal")
+	if err := os.Rename(restore_filename, db_filename); err != nil {
+		return err
+	}
+	// Archives of older versions are migrated
+	db, err := openStorage("sqlite3://" + db_filename)
+	if err != nil {
+		return err
+	}
+	DB = db
+
+	if index_filename == "" {
+		return nil
+	}
+	index, new_filename, err := buildIndex(index_filename)
+	if err != nil {
+		return err
+	}
+	index.Close()
+	return replaceIndexFiles(new_filename, index_filename)
+}
+
+// backupFilename returns the name of a scheduled backup made at date
+func backupFilename(dir string, date time.Time) string {
+	return filepath.Join(dir, backupPrefix+date.Format("20060102T150405")+backupExtension)
+}
+
+// pruneBackups removes scheduled backups of dir but the keep latest ones
+func pruneBackups(dir string, keep int) (removed []string, err error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"+backupExtension))
+	if err != nil {
+		return nil, err
+	}
+	// Names sort by date
+	sort.Strings(filenames)
+	for len(filenames) > keep {
+		if err := os.Remove(filenames[0]); err != nil {
+			return removed, err
+		}
+		removed = append(removed, filenames[0])
+		filenames = filenames[1:]
+	}
+	return removed, nil
+}
+
+// scheduleBackups returns a background worker backing up db_filename in dir
+// every interval, until gobookmark stops
+func scheduleBackups(db_filename string, dir string, interval time.Duration, keep int) func(logger *Logger) error {
+	return func(logger *Logger) error {
+		for {
+			select {
+			case <-stopping:
+				return nil
+			case <-time.After(interval):
+			}
+			filename := backupFilename(dir, time.Now())
+			if err := writeBackup(filename, db_filename); err != nil {
+				logger.Error("scheduled backup failed", "file", filename, "error", err)
+				continue
+			}
+			logger.Info("scheduled backup written", "file", filename)
+			removed, err := pruneBackups(dir, keep)
+			for _, old := range removed {
+				logger.Info("old backup removed", "file", old)
+			}
+			if err != nil {
+				logger.Error("old backups removal failed", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// cborMaxDepth limits nested arrays and maps
+const cborMaxDepth = 16
+
+var errCborTruncated = errors.New("cbor: truncated data")
+
+// cborDecode decodes the first CBOR item of data, and returns it with the
+// remaining bytes. Only the subset used by WebAuthn is supported: integers
+// (int64), byte strings ([]byte), text strings (string), arrays
+// ([]interface{}), maps (map[interface{}]interface{}), tags, booleans and
+// null.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeHeader(data []byte) (major byte, value uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errCborTruncated
+	}
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, 0, nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: too deeply nested")
+	}
+	major, value, data, err := cborDecodeHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if value > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(value), data, nil
+	case 1:
+		if value > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(value), data, nil
+	case 2, 3:
+		if value > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+		if major == 2 {
+			return data[:value], data[value:], nil
+		}
+		return string(data[:value]), data[value:], nil
+	case 4:
+		if value > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+		items := make([]interface{}, 0, value)
+		for i := uint64(0); i < value; i++ {
+			var item interface{}
+			item, data, err = cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if value > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+		items := make(map[interface{}]interface{}, value)
+		for i := uint64(0); i < value; i++ {
+			var key, item interface{}
+			key, data, err = cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+			item, data, err = cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = item
+		}
+		return items, data, nil
+	case 6:
+		return cborDecodeDepth(data, depth+1)
+	case 7:
+		switch value {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported item (major type %d)", major)
+}
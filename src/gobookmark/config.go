@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the effective configuration. Each setting is read from its
+// command line flag, its environment variable, the --config file and its
+// default value, in that order. Settings with restart tag are read at
+// startup only, SIGHUP reloads the others.
+type Config struct {
+	Server   ServerConfig   `toml:"server" yaml:"server"`
+	Storage  StorageConfig  `toml:"storage" yaml:"storage"`
+	Auth     AuthConfig     `toml:"auth" yaml:"auth"`
+	Fetcher  FetcherConfig  `toml:"fetcher" yaml:"fetcher"`
+	Indexing IndexingConfig `toml:"indexing" yaml:"indexing"`
+	Log      LogConfig      `toml:"log" yaml:"log"`
+	Metrics  MetricsConfig  `toml:"metrics" yaml:"metrics"`
+	Backup   BackupConfig   `toml:"backup" yaml:"backup"`
+}
+
+type ServerConfig struct {
+	Host           string   `toml:"host" yaml:"host" flag:"host" env:"GOBOOKMARK_HOST" restart:"true"`
+	Port           string   `toml:"port" yaml:"port" flag:"port, p" env:"GOBOOKMARK_PORT" restart:"true"`
+	BasePath       string   `toml:"base_path" yaml:"base_path" flag:"base-path" env:"GOBOOKMARK_BASE_PATH" restart:"true"`
+	TrustedProxies []string `toml:"trusted_proxies" yaml:"trusted_proxies" flag:"trusted-proxies" env:"GOBOOKMARK_TRUSTED_PROXIES"`
+	ItemsByPage    int      `toml:"items_by_page" yaml:"items_by_page" flag:"items-by-page" env:"GOBOOKMARK_ITEMS_BY_PAGE"`
+	SessionName    string   `toml:"session_name" yaml:"session_name" flag:"session-name" env:"GOBOOKMARK_SESSION_NAME" restart:"true"`
+	SessionKeys    string   `toml:"session_keys" yaml:"session_keys" flag:"session-keys" env:"GOBOOKMARK_SESSION_KEYS" secret:"true" restart:"true"`
+	CookieSecure   bool     `toml:"cookie_secure" yaml:"cookie_secure" flag:"cookie-secure" env:"GOBOOKMARK_COOKIE_SECURE" restart:"true"`
+	CookieMaxAge   int      `toml:"cookie_max_age" yaml:"cookie_max_age" flag:"cookie-max-age" env:"GOBOOKMARK_COOKIE_MAX_AGE" restart:"true"`
+	CookieSameSite string   `toml:"cookie_samesite" yaml:"cookie_samesite" flag:"cookie-samesite" env:"GOBOOKMARK_COOKIE_SAMESITE" restart:"true"`
+	// Timeouts are durations such as "30s"
+	ReadTimeout     string `toml:"read_timeout" yaml:"read_timeout" flag:"read-timeout" env:"GOBOOKMARK_READ_TIMEOUT" restart:"true"`
+	WriteTimeout    string `toml:"write_timeout" yaml:"write_timeout" flag:"write-timeout" env:"GOBOOKMARK_WRITE_TIMEOUT" restart:"true"`
+	ShutdownTimeout string `toml:"shutdown_timeout" yaml:"shutdown_timeout" flag:"shutdown-timeout" env:"GOBOOKMARK_SHUTDOWN_TIMEOUT" restart:"true"`
+	// HTTPS is served when TLS certificate and key files are set
+	TlsCert               string `toml:"tls_cert" yaml:"tls_cert" flag:"tls-cert" env:"GOBOOKMARK_TLS_CERT" restart:"true"`
+	TlsKey                string `toml:"tls_key" yaml:"tls_key" flag:"tls-key" env:"GOBOOKMARK_TLS_KEY" restart:"true"`
+	HttpRedirect          string `toml:"http_redirect" yaml:"http_redirect" flag:"http-redirect" env:"GOBOOKMARK_HTTP_REDIRECT" restart:"true"`
+	HstsMaxAge            int    `toml:"hsts_max_age" yaml:"hsts_max_age" flag:"hsts-max-age" env:"GOBOOKMARK_HSTS_MAX_AGE"`
+	HstsIncludeSubdomains bool   `toml:"hsts_include_subdomains" yaml:"hsts_include_subdomains" flag:"hsts-include-subdomains" env:"GOBOOKMARK_HSTS_INCLUDE_SUBDOMAINS"`
+	// Socket replaces host and port by a unix socket
+	Socket     string `toml:"socket" yaml:"socket" flag:"socket" env:"GOBOOKMARK_SOCKET" restart:"true"`
+	SocketMode string `toml:"socket_mode" yaml:"socket_mode" flag:"socket-mode" env:"GOBOOKMARK_SOCKET_MODE" restart:"true"`
+}
+
+type StorageConfig struct {
+	Data string `toml:"data" yaml:"data" flag:"data, d" env:"GOBOOKMARK_DATABASE" restart:"true"`
+	// Database is a sqlite3:// or postgres:// url, <data>.db SQLite database
+	// is used when it's empty
+	Database string `toml:"database" yaml:"database" flag:"database-url" env:"GOBOOKMARK_DATABASE_URL" secret:"true" restart:"true"`
+}
+
+type AuthConfig struct {
+	Password             string     `toml:"password" yaml:"password" flag:"password" env:"GOBOOKMARK_PASSWORD" secret:"true"`
+	AllowDefaultPassword bool       `toml:"allow_default_password" yaml:"allow_default_password" flag:"allow-default-password" env:"GOBOOKMARK_ALLOW_DEFAULT_PASSWORD"`
+	Header               string     `toml:"header" yaml:"header" flag:"auth-header" env:"GOBOOKMARK_AUTH_HEADER"`
+	WebAuthnOrigin       string     `toml:"webauthn_origin" yaml:"webauthn_origin" flag:"webauthn-origin" env:"GOBOOKMARK_WEBAUTHN_ORIGIN"`
+	Oidc                 OidcConfig `toml:"oidc" yaml:"oidc"`
+}
+
+type FetcherConfig struct {
+	Timeout   string `toml:"timeout" yaml:"timeout" flag:"fetch-timeout" env:"GOBOOKMARK_FETCH_TIMEOUT"`
+	UserAgent string `toml:"user_agent" yaml:"user_agent" flag:"fetch-user-agent" env:"GOBOOKMARK_FETCH_USER_AGENT"`
+}
+
+type IndexingConfig struct {
+	Engine    string `toml:"engine" yaml:"engine" flag:"search-engine" env:"GOBOOKMARK_SEARCH_ENGINE" restart:"true"`
+	Language  string `toml:"language" yaml:"language" flag:"language" env:"GOBOOKMARK_LANGUAGE" restart:"true"`
+	BatchSize int    `toml:"batch_size" yaml:"batch_size" flag:"index-batch-size" env:"GOBOOKMARK_INDEX_BATCH_SIZE" restart:"true"`
+}
+
+type LogConfig struct {
+	Level  string `toml:"level" yaml:"level" flag:"log-level" env:"GOBOOKMARK_LOG_LEVEL"`
+	Format string `toml:"format" yaml:"format" flag:"log-format" env:"GOBOOKMARK_LOG_FORMAT"`
+}
+
+// MetricsConfig Listen serves /metrics on its own address instead of the web
+// server one, for example 127.0.0.1:9100
+type MetricsConfig struct {
+	Enabled bool   `toml:"enabled" yaml:"enabled" flag:"metrics" env:"GOBOOKMARK_METRICS" restart:"true"`
+	Listen  string `toml:"listen" yaml:"listen" flag:"metrics-listen" env:"GOBOOKMARK_METRICS_LISTEN" restart:"true"`
+}
+
+// BackupConfig Interval schedules backups in Dir from the web command,
+// the Keep latest ones are kept
+type BackupConfig struct {
+	Dir      string `toml:"dir" yaml:"dir" flag:"backup-dir" env:"GOBOOKMARK_BACKUP_DIR" restart:"true"`
+	Interval string `toml:"interval" yaml:"interval" flag:"backup-interval" env:"GOBOOKMARK_BACKUP_INTERVAL" restart:"true"`
+	Keep     int    `toml:"keep" yaml:"keep" flag:"backup-keep" env:"GOBOOKMARK_BACKUP_KEEP" restart:"true"`
+}
+
+// CONFIG is loaded before commands run, web command adds its flags
+var CONFIG *Config
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:            "localhost",
+			Port:            "8000",
+			TrustedProxies:  []string{},
+			ItemsByPage:     25,
+			SessionName:     "my_session",
+			CookieMaxAge:    86400 * 30,
+			CookieSameSite:  "lax",
+			ReadTimeout:     "15s",
+			WriteTimeout:    "60s",
+			ShutdownTimeout: "30s",
+			HstsMaxAge:      15552000,
+			SocketMode:      "0660",
+		},
+		Storage: StorageConfig{
+			Data: "gobookmark",
+		},
+		Auth: AuthConfig{
+			Oidc: OidcConfig{
+				AllowedSubjects: []string{},
+				AllowedGroups:   []string{},
+				GroupsClaim:     "groups",
+			},
+		},
+		Fetcher: FetcherConfig{
+			Timeout:   "10s",
+			UserAgent: "GoBookmark",
+		},
+		Indexing: IndexingConfig{
+			Engine:    searchEngineBleve,
+			Language:  "en",
+			BatchSize: 100,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+		Backup: BackupConfig{
+			Keep: 7,
+		},
+	}
+}
+
+// loadConfigFile reads TOML or YAML filename, according to its extension,
+// over config
+func loadConfigFile(config *Config, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		metadata, err := toml.Decode(string(data), config)
+		if err != nil {
+			return fmt.Errorf("%s : %v", filename, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s : unknown setting %s", filename, undecoded[0])
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("%s : %v", filename, err)
+		}
+	default:
+		return fmt.Errorf("%s : config file extension must be .toml, .yaml or .yml", filename)
+	}
+	return nil
+}
+
+// configFields calls fn with each setting of config
+func configFields(config *Config, fn func(field reflect.StructField, value reflect.Value) error) error {
+	var walk func(value reflect.Value) error
+	walk = func(value reflect.Value) error {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				if err := walk(value.Field(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(field, value.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(reflect.ValueOf(config).Elem())
+}
+
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(i))
+	case reflect.Slice:
+		value.Set(reflect.ValueOf(splitList(raw)))
+	default:
+		return fmt.Errorf("%s settings aren't supported", value.Kind())
+	}
+	return nil
+}
+
+// applyEnv overrides config with environment variables
+func applyEnv(config *Config) error {
+	return configFields(config, func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("env")
+		if name == "" {
+			return nil
+		}
+		// Empty variables are ignored, like flags environment variables
+		raw := os.Getenv(name)
+		if raw == "" {
+			return nil
+		}
+		if err := setConfigValue(value, raw); err != nil {
+			return fmt.Errorf("%s environment variable : %v", name, err)
+		}
+		return nil
+	})
+}
+
+// applyFlags overrides config with flags given on c command line
+func applyFlags(config *Config, c *cli.Context) error {
+	return configFields(config, func(field reflect.StructField, value reflect.Value) error {
+		names := field.Tag.Get("flag")
+		if names == "" {
+			return nil
+		}
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if !c.IsSet(name) {
+				continue
+			}
+			if err := setConfigValue(value, c.String(name)); err != nil {
+				return fmt.Errorf("--%s flag : %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (config *Config) validate() error {
+	port, err := strconv.Atoi(config.Server.Port)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("server port %q isn't valid", config.Server.Port)
+	}
+	config.Server.BasePath = strings.TrimRight(config.Server.BasePath, "/")
+	if config.Server.BasePath != "" && !strings.HasPrefix(config.Server.BasePath, "/") {
+		return fmt.Errorf("server base path %q must start with /", config.Server.BasePath)
+	}
+	if _, err := parseTrustedProxies(strings.Join(config.Server.TrustedProxies, ",")); err != nil {
+		return fmt.Errorf("server trusted proxies : %v", err)
+	}
+	if config.Server.ItemsByPage < 1 || config.Server.ItemsByPage > maxItemsByPage {
+		return fmt.Errorf("server items by page must be between 1 and %d", maxItemsByPage)
+	}
+	if config.Server.SessionName == "" || strings.ContainsAny(config.Server.SessionName, "=;, \t") {
+		return fmt.Errorf("server session name %q isn't a valid cookie name", config.Server.SessionName)
+	}
+	if config.Server.SessionKeys != "" {
+		if _, err := parseSessionKeys(config.Server.SessionKeys); err != nil {
+			return fmt.Errorf("server session keys : %v", err)
+		}
+	}
+	if !isValidSameSite(config.Server.CookieSameSite) {
+		return fmt.Errorf("%s isn't a valid SameSite value", config.Server.CookieSameSite)
+	}
+	// Browsers reject SameSite=None cookies without Secure
+	if strings.ToLower(config.Server.CookieSameSite) == "none" && !config.Server.CookieSecure {
+		return errors.New("server cookie samesite none requires cookie secure")
+	}
+	if (config.Server.TlsCert == "") != (config.Server.TlsKey == "") {
+		return errors.New("server tls cert and tls key must be set together")
+	}
+	if config.Server.HttpRedirect != "" {
+		if config.Server.TlsCert == "" {
+			return errors.New("server http redirect requires tls cert and tls key")
+		}
+		if config.Server.Socket != "" {
+			return errors.New("server http redirect can't be used with socket")
+		}
+		if _, _, err := net.SplitHostPort(config.Server.HttpRedirect); err != nil {
+			return fmt.Errorf("server http redirect %q isn't a valid address", config.Server.HttpRedirect)
+		}
+	}
+	if config.Server.HstsMaxAge < 0 {
+		return errors.New("server hsts max age can't be negative")
+	}
+	if _, err := socketMode(config.Server.SocketMode); err != nil {
+		return fmt.Errorf("server socket mode %q isn't a valid octal mode", config.Server.SocketMode)
+	}
+	if config.Storage.Data == "" {
+		return errors.New("storage data is required")
+	}
+	switch storageScheme(config.Storage.Database) {
+	case "", "sqlite3", "postgres":
+	default:
+		return fmt.Errorf("storage database %q isn't a sqlite3:// or postgres:// url", redactedUrl(config.Storage.Database))
+	}
+	if config.Auth.Header != "" && len(config.Server.TrustedProxies) == 0 && config.Server.Socket == "" {
+		return errors.New("auth header requires server trusted proxies or socket, otherwise any client could set it")
+	}
+	if config.Auth.Oidc.Issuer != "" {
+		if _, err := newOidcProvider(config.Auth.Oidc); err != nil {
+			return err
+		}
+	}
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"server read timeout", config.Server.ReadTimeout},
+		{"server write timeout", config.Server.WriteTimeout},
+		{"server shutdown timeout", config.Server.ShutdownTimeout},
+		{"fetcher timeout", config.Fetcher.Timeout},
+	}
+	for _, duration := range durations {
+		if d, err := time.ParseDuration(duration.value); err != nil || d <= 0 {
+			return fmt.Errorf("%s %q isn't a valid duration", duration.name, duration.value)
+		}
+	}
+	if !isSupportedLanguage(config.Indexing.Language) {
+		return fmt.Errorf(
+			"%s language isn't supported (supported languages : %s)",
+			config.Indexing.Language,
+			strings.Join(supportedLanguages(), ", "),
+		)
+	}
+	if !isSearchEngine(config.Indexing.Engine) {
+		return fmt.Errorf(
+			"%s search engine isn't supported (supported engines : %s)",
+			config.Indexing.Engine,
+			strings.Join(searchEngines, ", "),
+		)
+	}
+	if config.Indexing.Engine == searchEngineFts5 {
+		if _, ok := sqliteFilename(storageUrl(config.Storage)); !ok {
+			return errors.New("fts5 search engine requires a SQLite database")
+		}
+	}
+	if config.Indexing.BatchSize < 1 {
+		return errors.New("indexing batch size must be positive")
+	}
+	if config.Metrics.Listen != "" {
+		if !config.Metrics.Enabled {
+			return errors.New("metrics listen requires metrics to be enabled")
+		}
+		if _, _, err := net.SplitHostPort(config.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics listen %q isn't a valid address", config.Metrics.Listen)
+		}
+	}
+	if config.Backup.Interval != "" {
+		if d, err := time.ParseDuration(config.Backup.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("backup interval %q isn't a valid duration", config.Backup.Interval)
+		}
+		if config.Backup.Dir == "" {
+			return errors.New("backup interval requires backup dir")
+		}
+		if _, ok := sqliteFilename(storageUrl(config.Storage)); !ok {
+			return errors.New("backup interval requires a SQLite database, back up PostgreSQL with pg_dump")
+		}
+	}
+	if config.Backup.Keep < 1 {
+		return errors.New("backup keep must be positive")
+	}
+	if _, err := parseLogLevel(config.Log.Level); err != nil {
+		return fmt.Errorf("log level : %v", err)
+	}
+	if !isLogFormat(config.Log.Format) {
+		return fmt.Errorf("log format %q isn't supported (%s)", config.Log.Format, strings.Join(logFormats, ", "))
+	}
+	return nil
+}
+
+// loadConfig returns the configuration of c, built from defaults, file,
+// environment and global flags
+func loadConfig(c *cli.Context) (*Config, error) {
+	config := defaultConfig()
+	if c.String("config") != "" {
+		if err := loadConfigFile(config, c.String("config")); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+	if err := applyFlags(config, c); err != nil {
+		return nil, err
+	}
+	return config, config.validate()
+}
+
+// apply sets the package variables configured by config
+func (config *Config) apply() {
+	DefaultLanguage = config.Indexing.Language
+	indexBatchSize = config.Indexing.BatchSize
+	BasePath = config.Server.BasePath
+	Session.Name = config.Server.SessionName
+	Session.Secure = config.Server.CookieSecure
+	Session.MaxAge = config.Server.CookieMaxAge
+	Session.SameSite = config.Server.CookieSameSite
+	ServeMetrics = config.Metrics.Enabled && config.Metrics.Listen == ""
+	config.applyReloadable()
+}
+
+// Settings are the settings without restart tag read while serving
+// requests. They are never modified, changes replace them as a whole so
+// requests read them without lock while SIGHUP reloads configuration.
+type Settings struct {
+	ItemsByPage int
+	// HstsMaxAge is the Strict-Transport-Security max-age sent on HTTPS
+	// responses, HSTS is disabled when 0
+	HstsMaxAge            int
+	HstsIncludeSubdomains bool
+	// TrustedProxies are the addresses allowed to set X-Forwarded-For header
+	TrustedProxies []*net.IPNet
+	// AuthHeader is the header an authentication proxy sets with the logged
+	// in user name, for example X-Remote-User. It is trusted only on
+	// requests sent by TrustedProxies or through the unix socket, header
+	// authentication is disabled when empty.
+	AuthHeader string
+	// WebAuthnOrigin is the origin expected in WebAuthn client data, for
+	// example "https://bm.example.com". When empty it is built from request
+	// host.
+	WebAuthnOrigin string
+	// OIDC is nil when OpenID Connect login is disabled
+	OIDC           *oidcProvider
+	FetchClient    *http.Client
+	FetchUserAgent string
+	// PasswordHash is the bcrypt hash of the login password, nil means the
+	// default password is used
+	PasswordHash []byte
+}
+
+var (
+	currentSettings atomic.Value
+	// settingsLock serializes settings changes
+	settingsLock sync.Mutex
+)
+
+func init() {
+	currentSettings.Store(&Settings{
+		ItemsByPage:    25,
+		HstsMaxAge:     15552000,
+		FetchClient:    &http.Client{Timeout: 10 * time.Second},
+		FetchUserAgent: "GoBookmark",
+	})
+}
+
+// settings returns the current settings, they must not be modified
+func settings() *Settings {
+	return currentSettings.Load().(*Settings)
+}
+
+// changeSettings replaces current settings by a copy modified by change
+func changeSettings(change func(s *Settings)) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	changed := *settings()
+	change(&changed)
+	currentSettings.Store(&changed)
+}
+
+// applyReloadable sets the settings without restart tag
+func (config *Config) applyReloadable() {
+	level, _ := parseLogLevel(config.Log.Level)
+	setLogSettings(level, config.Log.Format)
+	trusted_proxies, _ := parseTrustedProxies(strings.Join(config.Server.TrustedProxies, ","))
+	var oidc *oidcProvider
+	if config.Auth.Oidc.Issuer != "" {
+		oidc, _ = newOidcProvider(config.Auth.Oidc)
+	}
+	timeout, _ := time.ParseDuration(config.Fetcher.Timeout)
+	changeSettings(func(s *Settings) {
+		s.ItemsByPage = config.Server.ItemsByPage
+		s.HstsMaxAge = config.Server.HstsMaxAge
+		s.HstsIncludeSubdomains = config.Server.HstsIncludeSubdomains
+		s.TrustedProxies = trusted_proxies
+		s.AuthHeader = config.Auth.Header
+		s.WebAuthnOrigin = strings.TrimRight(config.Auth.WebAuthnOrigin, "/")
+		s.OIDC = oidc
+		s.FetchClient = &http.Client{Timeout: timeout}
+		s.FetchUserAgent = config.Fetcher.UserAgent
+	})
+}
+
+// socketMode parses an octal unix socket permission mode such as "0660"
+func socketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q isn't a valid mode", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// duration returns a validated duration setting
+func duration(value string) time.Duration {
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+// keepRestartSettings sets back in config the settings with restart tag
+// which differ from previous, and returns their names
+func keepRestartSettings(config *Config, previous *Config) (names []string) {
+	previous_value := reflect.ValueOf(previous).Elem()
+	var walk func(value reflect.Value, previous_value reflect.Value, prefix string)
+	walk = func(value reflect.Value, previous_value reflect.Value, prefix string) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := prefix + field.Tag.Get("toml")
+			if field.Type.Kind() == reflect.Struct {
+				walk(value.Field(i), previous_value.Field(i), name+".")
+				continue
+			}
+			if field.Tag.Get("restart") == "" {
+				continue
+			}
+			if !reflect.DeepEqual(value.Field(i).Interface(), previous_value.Field(i).Interface()) {
+				value.Field(i).Set(previous_value.Field(i))
+				names = append(names, name)
+			}
+		}
+	}
+	walk(reflect.ValueOf(config).Elem(), previous_value, "")
+	return names
+}
+
+// reloadConfig reads configuration of c web command again, settings which
+// require a restart keep their current value
+func reloadConfig(c *cli.Context) error {
+	config, err := loadConfig(c.Parent())
+	if err == nil {
+		err = applyFlags(config, c)
+	}
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range keepRestartSettings(config, CONFIG) {
+		LOG.Warn("setting change is ignored until restart", "setting", name)
+	}
+
+	password_hash, err := loadPasswordHash(config.Auth.Password)
+	if err != nil {
+		return err
+	}
+	CONFIG = config
+	config.applyReloadable()
+	changeSettings(func(s *Settings) { s.PasswordHash = password_hash })
+	return nil
+}
+
+// show returns config as TOML, secrets are masked
+func (config *Config) show() (string, error) {
+	masked := *config
+	configFields(&masked, func(field reflect.StructField, value reflect.Value) error {
+		if field.Tag.Get("secret") != "" {
+			value.SetString(maskSecret(value.String()))
+		}
+		return nil
+	})
+
+	var buffer bytes.Buffer
+	err := toml.NewEncoder(&buffer).Encode(&masked)
+	return buffer.String(), err
+}
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "********"
+}
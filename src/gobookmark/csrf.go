@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/goincremental/negroni-sessions"
+	"net/http"
+)
+
+const csrfTokenField = "csrf_token"
+
+const csrfTokenHeader = "X-CSRF-Token"
+
+// csrfToken returns the CSRF token of the session, it is created on first
+// call
+func csrfToken(r *http.Request) (string, error) {
+	session := sessions.GetSession(r)
+	if token, ok := session.Get(csrfTokenField).(string); ok && token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Set(csrfTokenField, token)
+	return token, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// CsrfMiddleware rejects state-changing requests which don't send the
+// session CSRF token in csrf_token form field or X-CSRF-Token header
+func CsrfMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isSafeMethod(r.Method) {
+		next(rw, r)
+		return
+	}
+
+	session := sessions.GetSession(r)
+	expected, _ := session.Get(csrfTokenField).(string)
+	token := r.Header.Get(csrfTokenHeader)
+	if token == "" {
+		token = r.FormValue(csrfTokenField)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(rw, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	next(rw, r)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/context"
+	"net/http"
+	"strings"
+)
+
+type ErrorKind int
+
+const (
+	ErrorInternal ErrorKind = iota
+	ErrorNotFound
+	ErrorValidation
+	ErrorConflict
+)
+
+// AppError is a domain error returned by model functions, Message is shown
+// to users while Err, its cause, is only logged. Fields holds validation
+// messages by form field
+type AppError struct {
+	Kind    ErrorKind
+	Message string
+	Fields  map[string]string
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + " : " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func notFoundError(format string, args ...interface{}) error {
+	return &AppError{Kind: ErrorNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func validationError(format string, args ...interface{}) error {
+	return &AppError{Kind: ErrorValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflictError(format string, args ...interface{}) error {
+	return &AppError{Kind: ErrorConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorKind returns ErrorInternal for errors which aren't an AppError
+func errorKind(err error) ErrorKind {
+	if e, ok := err.(*AppError); ok {
+		return e.Kind
+	}
+	return ErrorInternal
+}
+
+func isNotFound(err error) bool {
+	return errorKind(err) == ErrorNotFound
+}
+
+func errorStatus(err error) int {
+	switch errorKind(err) {
+	case ErrorNotFound:
+		return http.StatusNotFound
+	case ErrorValidation:
+		return http.StatusBadRequest
+	case ErrorConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// errorMessage hides internal errors details from users
+func errorMessage(err error) string {
+	if e, ok := err.(*AppError); ok && e.Kind != ErrorInternal {
+		return e.Message
+	}
+	return http.StatusText(http.StatusInternalServerError)
+}
+
+// wantsJson returns true for API requests and requests sent by scripts
+func wantsJson(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// renderError logs internal errors and writes err response
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	if errorKind(err) == ErrorInternal {
+		requestLogger(r).Error("request failed", "error", err)
+	} else {
+		requestLogger(r).Debug("request refused", "error", err)
+	}
+	writeError(w, r, err)
+}
+
+// writeError writes err as a JSON body or a HTML error page, with its
+// status code
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	message := errorMessage(err)
+	if wantsJson(r) {
+		writeJsonError(w, r, status, message)
+		return
+	}
+
+	t, err := getTemplate(r, "templates/error.html")
+	if err != nil {
+		requestLogger(r).Error("error page rendering failed", "error", err)
+		http.Error(w, message, status)
+		return
+	}
+	// The error page has no search form to fill
+	context.Set(r, "index_page", false)
+	if isLoggedIn(r) {
+		context.Set(r, "login", true)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = t.Execute(w, struct {
+		Status     int
+		StatusText string
+		Message    string
+	}{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+	})
+	if err != nil {
+		requestLogger(r).Error("error page rendering failed", "error", err)
+	}
+}
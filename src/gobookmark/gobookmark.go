@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/cheggaaa/pb"
@@ -8,9 +9,9 @@ import (
 	"github.com/codegangsta/negroni"
 	"github.com/dimfeld/httptreemux"
 	"github.com/goincremental/negroni-sessions"
-	"github.com/goincremental/negroni-sessions/cookiestore"
 	"github.com/gorilla/context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -19,10 +20,6 @@ import (
 	"time"
 )
 
-var (
-	Password string
-)
-
 func stringFlag(name, value, usage string, envvar string) cli.StringFlag {
 	return cli.StringFlag{
 		Name:   name,
@@ -32,61 +29,144 @@ func stringFlag(name, value, usage string, envvar string) cli.StringFlag {
 	}
 }
 
-func openDatabases(filename string) {
+func dataFilename(filename string, extension string) string {
 	cwd, _ := os.Getwd()
-	filename = path.Join(cwd, filename)
+	return fmt.Sprintf("%s.%s", path.Join(cwd, filename), extension)
+}
 
-	db_filename := fmt.Sprintf("%s.db", filename)
-	log.Printf("Use %s SqlLite database", db_filename)
-	DB = openDatabase(db_filename)
+func databasesFilenames(filename string) (db_filename string, index_filename string) {
+	return dataFilename(filename, "db"), dataFilename(filename, "index")
+}
 
-	index_filename := fmt.Sprintf("%s.index", filename)
-	log.Printf("Use %s Bleve database", index_filename)
-	INDEX = openBleve(index_filename)
+// openDatabase opens the database of config, it exits on failure
+func openDatabase(config StorageConfig) {
+	database_url := storageUrl(config)
+	LOG.Info("use database", "database", redactedUrl(database_url))
+	db, err := openStorage(database_url)
+	if err != nil {
+		LOG.Fatal("database opening failed", "database", redactedUrl(database_url), "error", err)
+	}
+	DB = db
 }
 
-func resetDatabases(filename string) {
-	cwd, _ := os.Getwd()
-	filename = path.Join(cwd, filename)
+// openDatabases opens the database and the search engine of config, it
+// exits on failure
+func openDatabases(config *Config) {
+	openDatabase(config.Storage)
 
-	db_filename := fmt.Sprintf("%s.db", filename)
-	log.Printf("Reset %s SqlLite database", db_filename)
-	os.Remove(db_filename)
+	_, index_filename := databasesFilenames(config.Storage.Data)
+	if config.Indexing.Engine == searchEngineBleve {
+		LOG.Info("use Bleve index", "index", index_filename)
+		lockBleveIndex(index_filename)
+	} else {
+		LOG.Info("use search engine", "engine", config.Indexing.Engine)
+	}
+	search, err := openSearchEngine(config.Indexing.Engine, index_filename)
+	if err != nil {
+		LOG.Fatal("search engine opening failed", "engine", config.Indexing.Engine, "error", err)
+	}
+	SEARCH = search
+}
 
-	index_filename := fmt.Sprintf("%s.index", filename)
-	log.Printf("Reset %s Bleve database", index_filename)
-	os.RemoveAll(index_filename)
+// lockBleveIndex locks index_filename index, it exits when another process
+// uses it
+func lockBleveIndex(index_filename string) {
+	if err := lockIndex(index_filename); err != nil {
+		LOG.Fatal("Bleve index locking failed", "index", index_filename, "error", err)
+	}
+}
+
+// sqliteDatabase returns the SQLite database filename of config, it exits
+// when the database isn't a SQLite one
+func sqliteDatabase(config StorageConfig, command string) string {
+	db_filename, ok := sqliteFilename(storageUrl(config))
+	if !ok {
+		LOG.Fatal(command + " requires a SQLite database, use pg_dump and pg_restore with PostgreSQL")
+	}
+	return db_filename
+}
+
+// runMigration migrates database url to target version, or prints the SQL
+// it would run with dry_run
+func runMigration(database_url string, target uint64, dry_run bool) {
+	if err := migrateDatabase(database_url, target, dry_run, os.Stdout); err != nil {
+		LOG.Fatal("migration failed", "database", redactedUrl(database_url), "target_version", target, "error", err)
+	}
+	if !dry_run {
+		LOG.Info("database migrated", "database", redactedUrl(database_url), "version", target)
+	}
 }
 
-const default_items_by_page = 25
+func resetDatabases(config StorageConfig) {
+	db_filename := sqliteDatabase(config, "reset")
+	_, index_filename := databasesFilenames(config.Data)
 
-func init() {
-	Password = "password"
+	LOG.Info("reset SQLite database", "database", db_filename)
+	os.Remove(db_filename)
+
+	LOG.Info("reset Bleve index", "index", index_filename)
+	os.RemoveAll(index_filename)
 }
 
 func GlobalVariableMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	context.Set(r, "login", false)
 	context.Set(r, "index_page", false)
+	context.Set(r, "remote_user", remoteUser(r))
+	setRequestUser(r)
 	next(rw, r)
 }
 
 func initApp() *negroni.Negroni {
-	router := httptreemux.New()
+	router := routeRecorder{httptreemux.New()}
 	router.GET("/", Index)
 	router.GET("/add/", Edit)
 	router.GET("/fetch-title/", FetchTitle)
 	router.POST("/add/", Save)
-	router.GET("/:id/delete/", Delete)
+	router.GET("/:id/delete/", DeleteForm)
+	router.POST("/:id/delete/", Delete)
 	router.GET("/:id/edit/", Edit)
 	router.POST("/:id/edit/", Save)
 	router.GET("/login/", LoginForm)
 	router.POST("/login/", Login)
-	router.GET("/logout/", Logout)
+	router.GET("/login/totp/", LoginTotpForm)
+	router.POST("/login/totp/", LoginTotp)
+	router.GET("/totp/", TotpSettings)
+	router.POST("/totp/", EnableTotp)
+	router.POST("/totp/disable/", DisableTotp)
+	router.GET("/totp/qr.png", TotpQrCode)
+	router.GET("/login/oidc/", LoginOidc)
+	router.GET("/login/oidc/callback/", LoginOidcCallback)
+	router.POST("/login/webauthn/begin/", LoginWebAuthnBegin)
+	router.POST("/login/webauthn/finish/", LoginWebAuthnFinish)
+	router.GET("/webauthn/", WebAuthnSettings)
+	router.POST("/webauthn/register/begin/", WebAuthnRegisterBegin)
+	router.POST("/webauthn/register/finish/", WebAuthnRegisterFinish)
+	router.POST("/webauthn/:id/delete/", DeleteWebAuthnCredential)
+	router.POST("/logout/", Logout)
+	router.POST("/reindex/", Reindex)
+	router.POST("/searches/", SaveSearch)
+	router.GET("/searches/:slug/", ShowSavedSearch)
+	router.GET("/searches/:slug/rss/", SavedSearchFeed)
+	router.POST("/searches/:slug/delete/", DeleteSavedSearch)
+	router.GET("/api/links/", ApiLinks)
+	router.GET("/api/searches/", ApiSavedSearches)
+	router.GET("/api/searches/:slug/", ApiSavedSearch)
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+	if ServeMetrics {
+		router.GET("/metrics", Metrics)
+	}
 
-	n := negroni.Classic()
+	n := negroni.New()
 
-	store := cookiestore.New([]byte("secret123"))
-	n.Use(sessions.Sessions("my_session", store))
+	n.Use(negroni.HandlerFunc(AccessLogMiddleware))
+	n.Use(negroni.HandlerFunc(RecoveryMiddleware))
+	n.Use(negroni.NewStatic(http.Dir("public")))
+	n.Use(negroni.HandlerFunc(HstsMiddleware))
+	n.Use(negroni.HandlerFunc(BasePathMiddleware))
+	n.Use(negroni.HandlerFunc(SameSiteMiddleware))
+	n.Use(sessions.Sessions(Session.Name, newSessionStore()))
+	n.Use(negroni.HandlerFunc(CsrfMiddleware))
 	n.Use(negroni.HandlerFunc(GlobalVariableMiddleware))
 	n.Use(negroni.NewStatic(
 		&AssetFS{
@@ -101,49 +181,82 @@ func initApp() *negroni.Negroni {
 	return n
 }
 
-func importFile(filename string) {
+// importFile imports links of a bookmarks HTML export, links failing
+// validation are skipped with a warning
+func importFile(filename string) error {
 	filename, err := absPath(filename)
-	checkErr(err)
+	if err != nil {
+		return err
+	}
 	f, err := os.Open(filename)
-	checkErr(err)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
 	doc, err := goquery.NewDocumentFromReader(f)
-	checkErr(err)
+	if err != nil {
+		return err
+	}
+	skipped := 0
 	items := doc.Find("DT > A")
 	bar := pb.StartNew(len(items.Nodes))
-	items.Each(func(i int, s *goquery.Selection) {
+	items.EachWithBreak(func(i int, s *goquery.Selection) bool {
 		bar.Increment()
-		add_date_str, _ := s.Attr("add_date")
-		add_date_int, err := strconv.ParseInt(add_date_str, 10, 64)
-		checkErr(err)
-
-		stmt, err := DB.Prepare("INSERT INTO links (title, url, createdate) VALUES(?, ?, ?)")
-		checkErr(err)
+		err = importBookmark(s)
+		if errorKind(err) == ErrorValidation {
+			href, _ := s.Attr("href")
+			LOG.Warn("bookmark skipped", "position", i+1, "url", href, "error", err)
+			skipped++
+			err = nil
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	bar.FinishPrint("The End!")
+	if skipped > 0 {
+		LOG.Warn("invalid bookmarks skipped", "count", skipped)
+	}
+	return nil
+}
 
-		href, _ := s.Attr("href")
+// importBookmark inserts and indexes the link of a bookmarks export entry
+func importBookmark(s *goquery.Selection) error {
+	add_date_str, _ := s.Attr("add_date")
+	add_date_int, err := strconv.ParseInt(add_date_str, 10, 64)
+	if err != nil {
+		return validationError("add_date %q is invalid", add_date_str)
+	}
 
-		bm := new(BookmarkItem)
-		bm.Title = s.Text()
-		bm.Url = href
-		bm.CreateDate = time.Unix(add_date_int, 0)
+	href, _ := s.Attr("href")
+	tags, _ := s.Attr("tags")
+	// Browsers export bookmarks without name with an empty title
+	title := strings.TrimSpace(s.Text())
+	if title == "" {
+		title = strings.TrimSpace(href)
+	}
+	link, err := validateLink(title, href, tags)
+	if err != nil {
+		return err
+	}
 
-		res, err := stmt.Exec(
-			bm.Title,
-			bm.Url,
-			bm.CreateDate,
-		)
-		checkErr(err)
+	bm := new(BookmarkItem)
+	bm.Title = link.Title
+	bm.Url = link.Url
+	bm.CreateDate = time.Unix(add_date_int, 0)
 
-		bm.Id, err = res.LastInsertId()
-		tags, _ := s.Attr("tags")
-		updateLinksTags(bm.Id, strings.Split(tags, ","))
+	if bm.Id, err = DB.ImportLink(bm.Title, bm.Url, bm.CreateDate, link.Tags); err != nil {
+		return err
+	}
 
-		// Index
+	// Index
 
-		bm.Tags = getLinksTags(bm.Id)
-		indexBookmarkItem(bm)
-	})
-	bar.FinishPrint("The End!")
+	if bm.Tags, err = getLinksTags(bm.Id); err != nil {
+		return err
+	}
+	return indexBookmarkItem(bm)
 }
 
 func main() {
@@ -151,8 +264,25 @@ func main() {
 	app.Name = "gobookmark"
 	app.Version = "0.1.0"
 	app.Usage = "A personnal bookmark service"
+	defaults := defaultConfig()
 	app.Flags = []cli.Flag{
-		stringFlag("data, d", "gobookmark", "Database filename", "GOBOOKMARK_DATABASE"),
+		stringFlag("config, c", "", "TOML (.toml) or YAML (.yaml) config file, flags and environment variables override its settings", "GOBOOKMARK_CONFIG"),
+		stringFlag("data, d", defaults.Storage.Data, "Database filename", "GOBOOKMARK_DATABASE"),
+		stringFlag("database-url", "", "sqlite3:// or postgres:// database url, <data>.db SQLite database when empty", "GOBOOKMARK_DATABASE_URL"),
+		stringFlag("language", defaults.Indexing.Language, "Language used when bookmark language can't be detected", "GOBOOKMARK_LANGUAGE"),
+		stringFlag("log-level", defaults.Log.Level, "Minimum level of logged records (debug, info, warn or error)", "GOBOOKMARK_LOG_LEVEL"),
+		stringFlag("log-format", defaults.Log.Format, "Log records format (logfmt or json)", "GOBOOKMARK_LOG_FORMAT"),
+	}
+	app.Before = func(c *cli.Context) error {
+		log.SetFlags(0)
+		log.SetOutput(stdLogWriter{})
+		var err error
+		CONFIG, err = loadConfig(c)
+		if err != nil {
+			return err
+		}
+		CONFIG.apply()
+		return nil
 	}
 	app.Commands = []cli.Command{
 		{
@@ -161,15 +291,252 @@ func main() {
 			Description: `Gobookmark web server is the only thing you need to run,
 and it takes care of all the other things for you`,
 			Flags: []cli.Flag{
-				stringFlag("port, p", "8000", "Web server port", "GOBOOKMARK_PORT"),
-				stringFlag("host", "localhost", "Web server host", "GOBOOKMARK_HOST"),
-				stringFlag("password", "password", "Set login password", "GOBOOKMARK_PASSWORD"),
+				stringFlag("port, p", defaults.Server.Port, "Web server port", "GOBOOKMARK_PORT"),
+				stringFlag("host", defaults.Server.Host, "Web server host", "GOBOOKMARK_HOST"),
+				stringFlag("base-path", "", "Path prefix when served under a sub-path by a reverse proxy, for example /bookmarks", "GOBOOKMARK_BASE_PATH"),
+				stringFlag("password", "", "Set login password, prefer the passwd command as flag is visible in process list", "GOBOOKMARK_PASSWORD"),
+				cli.BoolFlag{
+					Name:   "allow-default-password",
+					Usage:  "Start even if login password is the default one",
+					EnvVar: "GOBOOKMARK_ALLOW_DEFAULT_PASSWORD",
+				},
+				stringFlag("auth-header", "", "Header set by an authentication proxy with the logged in user, for example X-Remote-User, trusted only from --trusted-proxies", "GOBOOKMARK_AUTH_HEADER"),
+				cli.IntFlag{
+					Name:   "items-by-page",
+					Value:  defaults.Server.ItemsByPage,
+					Usage:  "Default number of links by page",
+					EnvVar: "GOBOOKMARK_ITEMS_BY_PAGE",
+				},
+				stringFlag("session-name", defaults.Server.SessionName, "Session cookie name", "GOBOOKMARK_SESSION_NAME"),
+				stringFlag("session-keys", "", "Session \"<hash key> <block key>\" hexadecimal pairs separated by commas, newest first (default: generated in <data>.secret file)", "GOBOOKMARK_SESSION_KEYS"),
+				cli.BoolFlag{
+					Name:   "cookie-secure",
+					Usage:  "Send session cookie only over HTTPS",
+					EnvVar: "GOBOOKMARK_COOKIE_SECURE",
+				},
+				cli.IntFlag{
+					Name:   "cookie-max-age",
+					Value:  defaults.Server.CookieMaxAge,
+					Usage:  "Session cookie max age in seconds",
+					EnvVar: "GOBOOKMARK_COOKIE_MAX_AGE",
+				},
+				stringFlag("cookie-samesite", defaults.Server.CookieSameSite, "Session cookie SameSite attribute (lax, strict, none or empty)", "GOBOOKMARK_COOKIE_SAMESITE"),
+				stringFlag("trusted-proxies", "", "Comma separated addresses or CIDR networks allowed to set X-Forwarded-For header", "GOBOOKMARK_TRUSTED_PROXIES"),
+				stringFlag("webauthn-origin", "", "Origin of passkey ceremonies, for example https://bm.example.com (default: built from request Host header)", "GOBOOKMARK_WEBAUTHN_ORIGIN"),
+				stringFlag("oidc-issuer", "", "OpenID Connect issuer URL, enables single sign-on", "GOBOOKMARK_OIDC_ISSUER"),
+				stringFlag("oidc-client-id", "", "OpenID Connect client id", "GOBOOKMARK_OIDC_CLIENT_ID"),
+				stringFlag("oidc-client-secret", "", "OpenID Connect client secret", "GOBOOKMARK_OIDC_CLIENT_SECRET"),
+				stringFlag("oidc-redirect-url", "", "OpenID Connect redirect URL (default: <request origin>/login/oidc/callback/)", "GOBOOKMARK_OIDC_REDIRECT_URL"),
+				stringFlag("oidc-allowed-subjects", "", "Comma separated subjects (sub claim) allowed to log in", "GOBOOKMARK_OIDC_ALLOWED_SUBJECTS"),
+				stringFlag("oidc-allowed-groups", "", "Comma separated groups allowed to log in", "GOBOOKMARK_OIDC_ALLOWED_GROUPS"),
+				stringFlag("oidc-groups-claim", defaults.Auth.Oidc.GroupsClaim, "ID token claim listing user groups", "GOBOOKMARK_OIDC_GROUPS_CLAIM"),
+				stringFlag("read-timeout", defaults.Server.ReadTimeout, "Maximum duration to read a request", "GOBOOKMARK_READ_TIMEOUT"),
+				stringFlag("write-timeout", defaults.Server.WriteTimeout, "Maximum duration to write a response", "GOBOOKMARK_WRITE_TIMEOUT"),
+				stringFlag("shutdown-timeout", defaults.Server.ShutdownTimeout, "Maximum duration to drain requests and stop background workers on SIGINT or SIGTERM", "GOBOOKMARK_SHUTDOWN_TIMEOUT"),
+				stringFlag("tls-cert", "", "TLS certificate file, serves HTTPS with --tls-key, reloaded when it changes", "GOBOOKMARK_TLS_CERT"),
+				stringFlag("tls-key", "", "TLS private key file", "GOBOOKMARK_TLS_KEY"),
+				stringFlag("http-redirect", "", "Address of a plain HTTP listener redirecting to HTTPS, for example :80", "GOBOOKMARK_HTTP_REDIRECT"),
+				cli.IntFlag{
+					Name:   "hsts-max-age",
+					Value:  defaults.Server.HstsMaxAge,
+					Usage:  "Strict-Transport-Security max age in seconds of HTTPS responses, 0 disables it",
+					EnvVar: "GOBOOKMARK_HSTS_MAX_AGE",
+				},
+				cli.BoolFlag{
+					Name:   "hsts-include-subdomains",
+					Usage:  "Add includeSubDomains to Strict-Transport-Security header",
+					EnvVar: "GOBOOKMARK_HSTS_INCLUDE_SUBDOMAINS",
+				},
+				stringFlag("socket", "", "Unix socket path to listen on instead of host and port", "GOBOOKMARK_SOCKET"),
+				stringFlag("socket-mode", defaults.Server.SocketMode, "Unix socket permissions", "GOBOOKMARK_SOCKET_MODE"),
+				stringFlag("fetch-timeout", defaults.Fetcher.Timeout, "Timeout of page title requests", "GOBOOKMARK_FETCH_TIMEOUT"),
+				stringFlag("fetch-user-agent", defaults.Fetcher.UserAgent, "User-Agent header of page title requests", "GOBOOKMARK_FETCH_USER_AGENT"),
+				stringFlag("search-engine", defaults.Indexing.Engine, "Search engine, bleve or fts5 (SQLite FTS5, no index directory)", "GOBOOKMARK_SEARCH_ENGINE"),
+				cli.IntFlag{
+					Name:   "index-batch-size",
+					Value:  defaults.Indexing.BatchSize,
+					Usage:  "Number of links indexed by batch",
+					EnvVar: "GOBOOKMARK_INDEX_BATCH_SIZE",
+				},
+				cli.BoolFlag{
+					Name:   "metrics",
+					Usage:  "Serve Prometheus metrics on /metrics",
+					EnvVar: "GOBOOKMARK_METRICS",
+				},
+				stringFlag("metrics-listen", "", "Address of a separate listener serving /metrics, for example 127.0.0.1:9100 (default: served by the web server)", "GOBOOKMARK_METRICS_LISTEN"),
+				stringFlag("backup-dir", "", "Directory of scheduled backups", "GOBOOKMARK_BACKUP_DIR"),
+				stringFlag("backup-interval", "", "Duration between scheduled backups, for example 24h (default: no scheduled backups)", "GOBOOKMARK_BACKUP_INTERVAL"),
+				cli.IntFlag{
+					Name:   "backup-keep",
+					Value:  defaults.Backup.Keep,
+					Usage:  "Number of scheduled backups kept",
+					EnvVar: "GOBOOKMARK_BACKUP_KEEP",
+				},
+			},
+			Action: func(c *cli.Context) {
+				err := applyFlags(CONFIG, c)
+				if err == nil {
+					err = CONFIG.validate()
+				}
+				if err != nil {
+					LOG.Fatal("invalid configuration", "error", err)
+				}
+				CONFIG.apply()
+				if CONFIG.Server.SessionKeys != "" {
+					Session.Keys, err = parseSessionKeys(CONFIG.Server.SessionKeys)
+				} else {
+					Session.Keys, err = loadSessionKeys(dataFilename(CONFIG.Storage.Data, "secret"))
+				}
+				if err != nil {
+					LOG.Fatal("session keys loading failed", "error", err)
+				}
+
+				openDatabases(CONFIG)
+				if err = loadPassword(CONFIG.Auth.Password); err != nil {
+					LOG.Fatal("login password loading failed", "error", err)
+				}
+				if isDefaultPassword() && !CONFIG.Auth.AllowDefaultPassword && CONFIG.Auth.Header == "" {
+					LOG.Fatal(
+						fmt.Sprintf("login password is the default one, set it with \"%s passwd\" or use --allow-default-password", os.Args[0]),
+						"default_password", defaultPassword,
+					)
+				}
+				if CONFIG.Indexing.Engine == searchEngineBleve && isIndexStale(currentIndex) {
+					mapping_version, _ := getIndexMappingVersion(currentIndex)
+					LOG.Warn(
+						"Bleve index mapping is stale, rebuild it in background",
+						"mapping_version", mapping_version,
+						"expected_mapping_version", indexMappingVersion,
+					)
+					goBackground(LOG, "Bleve index rebuild", rebuildIndex)
+				}
+				if CONFIG.Backup.Interval != "" {
+					if err := os.MkdirAll(CONFIG.Backup.Dir, 0700); err != nil {
+						LOG.Fatal("backup directory creation failed", "error", err)
+					}
+					db_filename, _ := sqliteFilename(storageUrl(CONFIG.Storage))
+					goBackground(LOG, "scheduled backup", scheduleBackups(
+						db_filename,
+						CONFIG.Backup.Dir,
+						duration(CONFIG.Backup.Interval),
+						CONFIG.Backup.Keep,
+					))
+					LOG.Info("backups scheduled", "dir", CONFIG.Backup.Dir, "interval", CONFIG.Backup.Interval)
+				}
+				read_timeout := duration(CONFIG.Server.ReadTimeout)
+				write_timeout := duration(CONFIG.Server.WriteTimeout)
+				addr := fmt.Sprintf("%s:%s", CONFIG.Server.Host, CONFIG.Server.Port)
+				server := newGracefulServer(addr, initApp(), read_timeout, write_timeout)
+
+				var listener net.Listener
+				if CONFIG.Server.Socket != "" {
+					addr = CONFIG.Server.Socket
+					mode, _ := socketMode(CONFIG.Server.SocketMode)
+					listener, err = listenUnix(addr, mode)
+					UnixSocket = true
+				} else {
+					listener, err = net.Listen("tcp", addr)
+				}
+				if err != nil {
+					LOG.Fatal("listening failed", "error", err)
+				}
+
+				var certificates *certificateLoader
+				if CONFIG.Server.TlsCert != "" {
+					certificates, err = newCertificateLoader(CONFIG.Server.TlsCert, CONFIG.Server.TlsKey)
+					if err != nil {
+						LOG.Fatal("TLS certificate loading failed", "error", err)
+					}
+					listener = tls.NewListener(listener, newTlsConfig(certificates))
+					LOG.Info("listening", "address", addr, "tls", true)
+				} else {
+					LOG.Info("listening", "address", addr, "tls", false)
+				}
+				servers := []listenedServer{{server, listener}}
+
+				if CONFIG.Server.HttpRedirect != "" {
+					redirect_listener, err := net.Listen("tcp", CONFIG.Server.HttpRedirect)
+					if err != nil {
+						LOG.Fatal("listening failed", "error", err)
+					}
+					redirect_server := newGracefulServer(
+						CONFIG.Server.HttpRedirect,
+						httpsRedirectHandler(CONFIG.Server.Port),
+						read_timeout,
+						write_timeout,
+					)
+					servers = append(servers, listenedServer{redirect_server, redirect_listener})
+					LOG.Info("redirecting HTTP to HTTPS", "address", CONFIG.Server.HttpRedirect)
+				}
+
+				if CONFIG.Metrics.Listen != "" {
+					metrics_listener, err := net.Listen("tcp", CONFIG.Metrics.Listen)
+					if err != nil {
+						LOG.Fatal("listening failed", "error", err)
+					}
+					metrics_server := newGracefulServer(
+						CONFIG.Metrics.Listen,
+						metricsServerHandler(),
+						read_timeout,
+						write_timeout,
+					)
+					servers = append(servers, listenedServer{metrics_server, metrics_listener})
+					LOG.Info("serving metrics", "address", CONFIG.Metrics.Listen)
+				}
+
+				workers_stopped, err := serve(servers, duration(CONFIG.Server.ShutdownTimeout), func() {
+					if certificates != nil {
+						if err := certificates.reload(); err != nil {
+							LOG.Error("TLS certificate reload failed", "error", err)
+						}
+					}
+					if err := reloadConfig(c); err != nil {
+						LOG.Error("configuration reload failed", "error", err)
+						return
+					}
+					LOG.Info("configuration reloaded")
+				})
+				if err != nil {
+					LOG.Error("server failed", "error", err)
+				}
+				if !workers_stopped {
+					// A rebuild or a catch-up may still write the index,
+					// closing it under them would corrupt it
+					LOG.Fatal("stopped without closing the index", "error", errWorkersRunning)
+				}
+				closeSwappableBleve()
+				DB.Close()
+				LOG.Info("stopped")
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Configuration commands",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "Print the effective configuration as TOML, secrets are masked",
+					Description: `Settings are read from flags, environment variables, the --config file
+and default values, in that order`,
+					Action: func(c *cli.Context) {
+						output, err := CONFIG.show()
+						if err != nil {
+							LOG.Fatal("configuration printing failed", "error", err)
+						}
+						fmt.Print(output)
+					},
+				},
 			},
+		},
+		{
+			Name:  "healthcheck",
+			Usage: "Check the web server is ready",
+			Description: `Request /readyz of the web server configured by the same settings,
+exit with status 1 when it isn't ready, for container healthchecks`,
 			Action: func(c *cli.Context) {
-				Password = c.String("password")
-				openDatabases(c.Parent().String("data"))
-				n := initApp()
-				n.Run(fmt.Sprintf("%s:%s", c.String("host"), c.String("port")))
+				if err := probeReadiness(CONFIG, 5*time.Second); err != nil {
+					LOG.Fatal("web server isn't ready", "error", err)
+				}
 			},
 		},
 		{
@@ -184,23 +551,202 @@ and it takes care of all the other things for you`,
 			ArgsUsage: "<input-file>",
 			Action: func(c *cli.Context) {
 				if len(c.Args()) == 0 {
-					log.Print("Error : <input-file> missing")
+					LOG.Error("<input-file> missing")
 				} else {
 					if c.Bool("reset") {
-						resetDatabases(c.Parent().String("data"))
+						resetDatabases(CONFIG.Storage)
+					}
+					openDatabases(CONFIG)
+					if err := importFile(c.Args()[0]); err != nil {
+						LOG.Fatal("import failed", "file", c.Args()[0], "error", err)
 					}
-					openDatabases(c.Parent().String("data"))
-					importFile(c.Args()[0])
 				}
 			},
 		},
+		{
+			Name:  "passwd",
+			Usage: "Set login password",
+			Description: `Prompt new login password and store its bcrypt hash in database,
+the password is read on stdin when it isn't a terminal`,
+			Action: func(c *cli.Context) {
+				openDatabase(CONFIG.Storage)
+				password, err := readNewPassword()
+				if err != nil {
+					LOG.Fatal("password reading failed", "error", err)
+				}
+				err = storePassword(password)
+				if err != nil {
+					LOG.Fatal("password storing failed", "error", err)
+				}
+				LOG.Info("login password updated")
+			},
+		},
+		{
+			Name:  "rotate-session-keys",
+			Usage: "Add new session keys in <data>.secret file",
+			Description: `Sessions signed with previous keys stay valid until the next rotation,
+restart the web server to use the new keys`,
+			Action: func(c *cli.Context) {
+				filename := dataFilename(CONFIG.Storage.Data, "secret")
+				err := rotateSessionKeys(filename)
+				if err != nil {
+					LOG.Fatal("session keys rotation failed", "error", err)
+				}
+				LOG.Info("session keys rotated", "file", filename)
+			},
+		},
+		{
+			Name:  "backup",
+			Usage: "Write a backup archive of the database",
+			Description: `Snapshot the database with SQLite online backup, the web server can
+keep running. The index isn't archived, restore rebuilds it`,
+			ArgsUsage: "<archive>",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					LOG.Fatal("<archive> missing")
+				}
+				db_filename := sqliteDatabase(CONFIG.Storage, "backup")
+				if err := writeBackup(c.Args()[0], db_filename); err != nil {
+					LOG.Fatal("backup failed", "error", err)
+				}
+				LOG.Info("backup written", "file", c.Args()[0])
+			},
+		},
+		{
+			Name:  "restore",
+			Usage: "Restore a backup archive",
+			Description: `Replace the database by the one of a backup archive and rebuild the
+index. Stop the web server before`,
+			ArgsUsage: "<archive>",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					LOG.Fatal("<archive> missing")
+				}
+				db_filename := sqliteDatabase(CONFIG.Storage, "restore")
+				_, index_filename := databasesFilenames(CONFIG.Storage.Data)
+				if CONFIG.Indexing.Engine == searchEngineFts5 {
+					index_filename = ""
+				} else {
+					lockBleveIndex(index_filename)
+				}
+				if err := restoreBackup(c.Args()[0], db_filename, index_filename); err != nil {
+					LOG.Fatal("restore failed", "error", err)
+				}
+				if CONFIG.Indexing.Engine == searchEngineFts5 {
+					if _, err := openFts5Search(); err != nil {
+						LOG.Fatal("SQLite FTS5 table creation failed", "error", err)
+					}
+				}
+				LOG.Info("backup restored", "file", c.Args()[0], "database", db_filename, "index", index_filename)
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "Database schema migration commands",
+			Description: `Migrations are applied by other commands on start. The database is
+backed up next to it, as <data>.db.v<version>-<date>.tar.gz, before being
+migrated (SQLite only, use pg_dump with PostgreSQL). Stop the web server before`,
+			Subcommands: []cli.Command{
+				{
+					Name:  "status",
+					Usage: "Print database schema version and applied migrations",
+					Action: func(c *cli.Context) {
+						if err := printMigrationsStatus(storageUrl(CONFIG.Storage), os.Stdout); err != nil {
+							LOG.Fatal("migration status failed", "error", err)
+						}
+					},
+				},
+				{
+					Name:  "up",
+					Usage: "Apply pending migrations",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "Print SQL of the migrations instead of applying them",
+						},
+					},
+					Action: func(c *cli.Context) {
+						database_url := storageUrl(CONFIG.Storage)
+						latest, err := latestMigrationVersion(database_url)
+						if err != nil {
+							LOG.Fatal("migration failed", "error", err)
+						}
+						runMigration(database_url, latest, c.Bool("dry-run"))
+					},
+				},
+				{
+					Name:  "down",
+					Usage: "Revert the last applied migration",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "Print SQL of the migrations instead of applying them",
+						},
+					},
+					Action: func(c *cli.Context) {
+						database_url := storageUrl(CONFIG.Storage)
+						previous, err := previousMigrationVersion(database_url)
+						if err != nil {
+							LOG.Fatal("migration failed", "error", err)
+						}
+						runMigration(database_url, previous, c.Bool("dry-run"))
+					},
+				},
+				{
+					Name:      "to",
+					Usage:     "Apply or revert migrations up to a version",
+					ArgsUsage: "<version>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "Print SQL of the migrations instead of applying them",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) == 0 {
+							LOG.Fatal("<version> missing")
+						}
+						target, err := strconv.ParseUint(c.Args()[0], 10, 64)
+						if err != nil {
+							LOG.Fatal("<version> must be a migration number", "version", c.Args()[0])
+						}
+						runMigration(storageUrl(CONFIG.Storage), target, c.Bool("dry-run"))
+					},
+				},
+			},
+		},
 		{
 			Name:  "reindex",
 			Usage: "Execute plain text search indexation",
+			Description: `Build a new Bleve index next to the current one and replace it, or
+refill the SQLite FTS5 table with the fts5 search engine. It's refused while a
+web server uses the Bleve index, which rebuilds it online by itself when its
+mapping is stale, or on "POST /reindex/" (refresh button)`,
 			Action: func(c *cli.Context) {
-				openDatabases(c.Parent().String("data"))
-				log.Print("Reindex database with Bleve")
-				indexAllBookmark()
+				openDatabase(CONFIG.Storage)
+				if CONFIG.Indexing.Engine == searchEngineFts5 {
+					search, err := openFts5Search()
+					if err == nil {
+						err = search.Rebuild(LOG)
+					}
+					if err != nil {
+						LOG.Fatal("SQLite FTS5 table rebuild failed", "error", err)
+					}
+					LOG.Info("SQLite FTS5 table rebuilt")
+					return
+				}
+				_, index_filename := databasesFilenames(CONFIG.Storage.Data)
+				lockBleveIndex(index_filename)
+				LOG.Info("build new Bleve index", "index", index_filename)
+				index, new_filename, err := buildIndex(index_filename)
+				if err != nil {
+					LOG.Fatal("Bleve index build failed", "index", new_filename, "error", err)
+				}
+				index.Close()
+				if err = replaceIndexFiles(new_filename, index_filename); err != nil {
+					LOG.Fatal("Bleve index replacement failed", "index", index_filename, "error", err)
+				}
+				LOG.Info("Bleve index replaced", "index", index_filename)
 			},
 		},
 	}
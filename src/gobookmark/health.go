@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mattes/migrate/migrate"
+	"net"
+	"net/http"
+	"time"
+)
+
+// checkResult returns a readiness check status with details given as key
+// value pairs
+func checkResult(err error, details ...interface{}) map[string]interface{} {
+	result := map[string]interface{}{"status": "ok"}
+	if err != nil {
+		result["status"] = "error"
+		result["error"] = err.Error()
+	}
+	for i := 0; i+1 < len(details); i += 2 {
+		result[fmt.Sprint(details[i])] = details[i+1]
+	}
+	return result
+}
+
+func checkDatabase() map[string]interface{} {
+	if DB == nil {
+		return checkResult(errors.New("database isn't opened"))
+	}
+	return checkResult(DB.Ping())
+}
+
+func checkMigrations() map[string]interface{} {
+	if DB == nil {
+		return checkResult(errors.New("database isn't opened"))
+	}
+	expected, err := latestMigrationVersion(DB.Url())
+	if err != nil {
+		return checkResult(err)
+	}
+	version, err := migrate.Version(DB.Url(), migrationsDir(DB.Url()))
+	if err == nil && version != expected {
+		err = fmt.Errorf("database schema version is %d, %d expected", version, expected)
+	}
+	return checkResult(err, "version", version, "expected_version", expected)
+}
+
+func checkIndex() map[string]interface{} {
+	count, err := SEARCH.Count()
+	if err != nil {
+		return checkResult(err)
+	}
+	return checkResult(nil, "documents", count)
+}
+
+// Healthz answers as long as the process serves requests
+func Healthz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	writeJson(w, r, map[string]string{"status": "ok"})
+}
+
+// Readyz checks database, schema migrations and index, it answers 503
+// Service Unavailable when one of them fails
+func Readyz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	checks := map[string]map[string]interface{}{
+		"database":   checkDatabase(),
+		"migrations": checkMigrations(),
+		"index":      checkIndex(),
+	}
+	status := "ok"
+	for name, check := range checks {
+		if check["status"] != "ok" {
+			requestLogger(r).Warn("readiness check failed", "check", name, "error", check["error"])
+			status = "unavailable"
+		}
+	}
+	if status != "ok" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJson(w, r, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// isProbe returns true for health and readiness requests, which are only
+// logged at debug level
+func isProbe(route string) bool {
+	return route == "/healthz" || route == "/readyz"
+}
+
+// probeReadiness requests /readyz of the web server configured by config,
+// it's used by container healthchecks
+func probeReadiness(config *Config, timeout time.Duration) error {
+	transport := &http.Transport{}
+	scheme := "http"
+	host := config.Server.Host
+	switch host {
+	case "", "0.0.0.0", "::":
+		host = "127.0.0.1"
+	}
+	host = net.JoinHostPort(host, config.Server.Port)
+	if config.Server.Socket != "" {
+		socket := config.Server.Socket
+		transport.Dial = func(_, _ string) (net.Conn, error) {
+			return net.DialTimeout("unix", socket, timeout)
+		}
+		host = "localhost"
+	}
+	if config.Server.TlsCert != "" {
+		// The certificate is issued for the public name, not the local address
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	resp, err := client.Get(scheme + "://" + host + config.Server.BasePath + "/readyz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("readiness check answered %s", resp.Status)
+	}
+	return nil
+}
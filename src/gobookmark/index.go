@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"github.com/blevesearch/bleve"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// indexMappingVersion must be incremented each time newIndexMapping changes,
+// indexes built with another version are rebuilt
+const indexMappingVersion = "3"
+
+var indexMappingVersionKey = []byte("mapping_version")
+
+var (
+	// indexFilename is the path of the index currently served by INDEX alias
+	indexFilename string
+	// currentIndex is the index currently served by INDEX alias
+	currentIndex bleve.Index
+
+	rebuildLock      sync.Mutex
+	pendingIndexLock sync.RWMutex
+	pendingIndex     bleve.Index
+	// pendingDeletedIds are links deleted while pendingIndex is built
+	pendingDeletedLock sync.Mutex
+	pendingDeletedIds  map[int64]bool
+
+	// indexLockFile is held while this process uses the index
+	indexLockFile *os.File
+)
+
+var errIndexLocked = errors.New("index is used by another gobookmark process, stop it or use its refresh button (POST /reindex/)")
+
+// lockIndex takes an exclusive lock on filename index until this process
+// exits, it returns errIndexLocked if another process holds it
+func lockIndex(filename string) error {
+	f, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errIndexLocked
+		}
+		return err
+	}
+	indexLockFile = f
+	return nil
+}
+
+func setIndexMappingVersion(index bleve.Index) error {
+	return index.SetInternal(indexMappingVersionKey, []byte(indexMappingVersion))
+}
+
+func getIndexMappingVersion(index bleve.Index) (string, error) {
+	version, err := index.GetInternal(indexMappingVersionKey)
+	return string(version), err
+}
+
+// isIndexStale returns true if index mapping version can't be read too,
+// rebuilding it is harmless
+func isIndexStale(index bleve.Index) bool {
+	version, err := getIndexMappingVersion(index)
+	return err != nil || version != indexMappingVersion
+}
+
+// updatePendingIndex calls update with the index being built, if any. The
+// catch up of buildIndex waits for running updates.
+func updatePendingIndex(update func(index bleve.Index) error) error {
+	pendingIndexLock.RLock()
+	defer pendingIndexLock.RUnlock()
+	if pendingIndex == nil {
+		return nil
+	}
+	return update(pendingIndex)
+}
+
+// unindexPending deletes id link from the index being built, if any
+func unindexPending(id int64) error {
+	return updatePendingIndex(func(index bleve.Index) error {
+		pendingDeletedLock.Lock()
+		pendingDeletedIds[id] = true
+		pendingDeletedLock.Unlock()
+		return index.Delete(strconv.FormatInt(id, 10))
+	})
+}
+
+func setPendingIndex(index bleve.Index) {
+	pendingIndexLock.Lock()
+	defer pendingIndexLock.Unlock()
+	pendingIndex = index
+	pendingDeletedLock.Lock()
+	pendingDeletedIds = make(map[int64]bool)
+	pendingDeletedLock.Unlock()
+}
+
+// catchUpPendingIndex indexes again in the index being built links changed
+// since its bulk indexation started, which may have overwritten their
+// updates, and deletes links deleted meanwhile. Updates wait until it's done.
+func catchUpPendingIndex(index bleve.Index, since string) error {
+	pendingIndexLock.Lock()
+	defer pendingIndexLock.Unlock()
+
+	bms, err := DB.UpdatedBookmarks(since)
+	if err != nil {
+		return err
+	}
+	if err := DB.LoadLinksTags(bms); err != nil {
+		return err
+	}
+	batch := index.NewBatch()
+	for _, bm := range bms {
+		if err := batch.Index(strconv.FormatInt(bm.Id, 10), newBookmarkDocument(bm)); err != nil {
+			return err
+		}
+	}
+	pendingDeletedLock.Lock()
+	for id := range pendingDeletedIds {
+		batch.Delete(strconv.FormatInt(id, 10))
+	}
+	pendingDeletedLock.Unlock()
+	return index.Batch(batch)
+}
+
+// openSwappableBleve opens filename index behind the INDEX alias, so it can
+// be replaced by rebuildIndex while searches are served
+func openSwappableBleve(filename string) error {
+	index, err := openBleve(filename)
+	if err != nil {
+		return err
+	}
+	indexFilename = filename
+	currentIndex = index
+	INDEX = bleve.NewIndexAlias(currentIndex)
+	return nil
+}
+
+func closeSwappableBleve() {
+	INDEX.Close()
+	currentIndex.Close()
+}
+
+// buildIndex indexes all bookmarks in a new index created next to filename,
+// the caller must move it to filename. Bookmarks saved meanwhile are indexed
+// in it too.
+func buildIndex(filename string) (index bleve.Index, new_filename string, err error) {
+	new_filename = filename + ".new"
+	err = os.RemoveAll(new_filename)
+	if err != nil {
+		return nil, "", err
+	}
+	index, err = bleve.New(new_filename, newIndexMapping())
+	if err != nil {
+		return nil, "", err
+	}
+	since, err := DB.CurrentTime()
+	if err != nil {
+		return index, new_filename, err
+	}
+	setPendingIndex(index)
+	if err = indexAllBookmarkInto(index); err != nil {
+		return index, new_filename, err
+	}
+	if err = catchUpPendingIndex(index, since); err != nil {
+		return index, new_filename, err
+	}
+	return index, new_filename, setIndexMappingVersion(index)
+}
+
+// replaceIndexFiles moves new_filename index files to filename. The previous
+// index is moved aside first and only removed once the new one is in place,
+// it's moved back if the new one can't be.
+func replaceIndexFiles(new_filename string, filename string) error {
+	old_filename := filename + ".old"
+	if err := os.RemoveAll(old_filename); err != nil {
+		return err
+	}
+	err := os.Rename(filename, old_filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(new_filename, filename); err != nil {
+		os.Rename(old_filename, filename)
+		return err
+	}
+	return os.RemoveAll(old_filename)
+}
+
+// rebuildIndex builds a new index with current mapping next to the served
+// one, then atomically swaps it in INDEX alias. Searches are served by the
+// previous index until the swap.
+func rebuildIndex(logger *Logger) error {
+	alias, ok := INDEX.(bleve.IndexAlias)
+	if !ok {
+		return errors.New("INDEX isn't opened with openSwappableBleve")
+	}
+
+	rebuildLock.Lock()
+	defer rebuildLock.Unlock()
+
+	logger.Info("build new Bleve index", "index", indexFilename, "mapping_version", indexMappingVersion)
+	new_index, new_filename, err := buildIndex(indexFilename)
+	defer setPendingIndex(nil)
+	if err != nil {
+		if new_index != nil {
+			new_index.Close()
+			os.RemoveAll(new_filename)
+		}
+		return err
+	}
+
+	alias.Swap([]bleve.Index{new_index}, []bleve.Index{currentIndex})
+	old_index := currentIndex
+	currentIndex = new_index
+	old_index.Close()
+	logger.Info("new Bleve index swapped in", "index", indexFilename)
+
+	// new_index keeps its opened files across the rename
+	return replaceIndexFiles(new_filename, indexFilename)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DefaultLanguage is used when the language of a bookmark can't be detected
+var DefaultLanguage = "en"
+
+// stopWords lists the most common words of each supported language, the
+// keys are the names of the matching Bleve analyzers
+var stopWords = map[string][]string{
+	"en": {
+		"the", "and", "of", "to", "in", "is", "for", "on", "with", "how",
+		"what", "this", "that", "are", "from", "your", "you", "an", "by",
+		"it", "be", "or", "at", "why", "new", "using", "about", "into",
+	},
+	"fr": {
+		"le", "la", "les", "de", "des", "du", "et", "un", "une", "est",
+		"pour", "dans", "sur", "avec", "au", "aux", "ce", "cette", "qui",
+		"que", "pas", "par", "comment", "vous", "nous", "en", "sont", "plus",
+	},
+	"de": {
+		"der", "die", "das", "und", "ist", "nicht", "mit", "von", "zu",
+		"den", "dem", "ein", "eine", "einer", "für", "auf", "im", "wie",
+		"sich", "auch", "es", "wir", "ihr", "sie", "oder", "aus", "bei",
+	},
+}
+
+func isSupportedLanguage(lang string) bool {
+	_, ok := stopWords[lang]
+	return ok
+}
+
+func supportedLanguages() (result []string) {
+	for lang := range stopWords {
+		result = append(result, lang)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// detectLanguage returns the supported language with the most stop words
+// found in text, DefaultLanguage if none is found
+func detectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c)
+	})
+
+	scores := make(map[string]int)
+	for _, word := range words {
+		for lang, lang_stop_words := range stopWords {
+			for _, stop_word := range lang_stop_words {
+				if word == stop_word {
+					scores[lang]++
+				}
+			}
+		}
+	}
+
+	result := DefaultLanguage
+	best_score := scores[DefaultLanguage]
+	for _, lang := range supportedLanguages() {
+		if scores[lang] > best_score {
+			result = lang
+			best_score = scores[lang]
+		}
+	}
+	return result
+}
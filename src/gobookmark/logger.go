@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/negroni"
+	"github.com/dimfeld/httptreemux"
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+func parseLogLevel(value string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.ToLower(value) == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("%q isn't a log level (%s)", value, strings.Join(logLevelNames, ", "))
+}
+
+var logFormats = []string{"logfmt", "json"}
+
+func isLogFormat(value string) bool {
+	return stringsContain(logFormats, value)
+}
+
+// Log settings, set by setLogSettings
+var (
+	logLock   sync.Mutex
+	logLevel            = LevelInfo
+	logFormat           = "logfmt"
+	logOutput io.Writer = os.Stderr
+	logNow              = time.Now
+)
+
+// setLogSettings sets level and format of records
+func setLogSettings(level LogLevel, format string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logLevel = level
+	logFormat = format
+}
+
+// Logger writes leveled records with key value fields, for example
+// LOG.Info("link saved", "id", 42)
+type Logger struct {
+	fields []interface{}
+}
+
+// LOG is the root logger, requestLogger adds request fields to it
+var LOG = &Logger{}
+
+// With returns a logger adding keyvals fields to each record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &Logger{fields: append(fields, keyvals...)}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// Fatal logs an error record and exits
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level LogLevel, msg string, keyvals []interface{}) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	if level < logLevel {
+		return
+	}
+
+	fields := []interface{}{
+		"time", logNow().Format(time.RFC3339),
+		"level", level.String(),
+		"msg", msg,
+	}
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buffer bytes.Buffer
+	if logFormat == "json" {
+		formatJsonRecord(&buffer, fields)
+	} else {
+		formatLogfmtRecord(&buffer, fields)
+	}
+	buffer.WriteByte('\n')
+	logOutput.Write(buffer.Bytes())
+}
+
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func formatJsonRecord(buffer *bytes.Buffer, fields []interface{}) {
+	buffer.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+}
+
+func formatLogfmtRecord(buffer *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(fmt.Sprint(fields[i]))
+		buffer.WriteByte('=')
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buffer.WriteString(value)
+	}
+}
+
+// stdLogWriter turns lines written by the standard log package, used by
+// libraries, into info records
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	LOG.Info(strings.TrimSpace(string(p)), "source", "stdlog")
+	return len(p), nil
+}
+
+// requestInfo is filled while a request is served and logged by
+// AccessLogMiddleware, it outlives the gorilla context cleared by sessions
+type requestInfo struct {
+	Id    string
+	Route string
+	User  string
+}
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func generateRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// getRequestInfo returns the info of r, or an empty one outside of
+// AccessLogMiddleware
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := context.Get(r, "request").(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// requestLogger returns a logger adding request id to records
+func requestLogger(r *http.Request) *Logger {
+	if id := getRequestInfo(r).Id; id != "" {
+		return LOG.With("request_id", id)
+	}
+	return LOG
+}
+
+// auditLogger returns the logger of security events such as logins
+func auditLogger(r *http.Request) *Logger {
+	return requestLogger(r).With("audit", true, "ip", clientIP(r))
+}
+
+// ownerUser is the access log user of password and passkey logins
+const ownerUser = "owner"
+
+// setRequestUser records the logged in user of r for access logs
+func setRequestUser(r *http.Request) {
+	info := getRequestInfo(r)
+	if user, _ := context.Get(r, "remote_user").(string); user != "" {
+		info.User = user
+		return
+	}
+	session := sessions.GetSession(r)
+	if session.Get("login") == nil {
+		return
+	}
+	if identity, ok := session.Get("identity").(string); ok && identity != "" {
+		info.User = identity
+	} else {
+		info.User = ownerUser
+	}
+}
+
+// routeRecorder records the matched route of requests for access logs
+type routeRecorder struct {
+	*httptreemux.TreeMux
+}
+
+func (router routeRecorder) Handle(method string, path string, handler httptreemux.HandlerFunc) {
+	router.TreeMux.Handle(method, path, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		getRequestInfo(r).Route = path
+		handler(w, r, params)
+	})
+}
+
+func (router routeRecorder) GET(path string, handler httptreemux.HandlerFunc) {
+	router.Handle("GET", path, handler)
+}
+
+func (router routeRecorder) POST(path string, handler httptreemux.HandlerFunc) {
+	router.Handle("POST", path, handler)
+}
+
+// AccessLogMiddleware gives an id to each request, accepting X-Request-Id
+// of trusted proxies, and logs requests once served
+func AccessLogMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	path := r.URL.Path
+	info := &requestInfo{Id: r.Header.Get("X-Request-Id")}
+	if !requestIdPattern.MatchString(info.Id) || !isTrustedPeer(r) {
+		info.Id = generateRequestId()
+	}
+	context.Set(r, "request", info)
+	rw.Header().Set("X-Request-Id", info.Id)
+
+	next(rw, r)
+
+	res := rw.(negroni.ResponseWriter)
+	elapsed := time.Since(start)
+	observeRequest(info.Route, r.Method, res.Status(), elapsed)
+	log_request := LOG.Info
+	if isProbe(info.Route) {
+		log_request = LOG.Debug
+	}
+	log_request(
+		"request",
+		"request_id", info.Id,
+		"method", r.Method,
+		"path", path,
+		"route", info.Route,
+		"status", res.Status(),
+		"bytes", res.Size(),
+		"duration_ms", elapsed.Seconds()*1000,
+		"user", info.User,
+		"ip", clientIP(r),
+	)
+}
+
+// RecoveryMiddleware logs panics of the next middlewares and handlers with
+// their stack and responds with the internal server error. The HTML page
+// needs the session, a plain text error is sent instead for panics raised
+// before GlobalVariableMiddleware.
+func RecoveryMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := make([]byte, 8192)
+			stack = stack[:runtime.Stack(stack, false)]
+			requestLogger(r).Error("panic", "error", fmt.Sprint(err), "stack", string(stack))
+			if res, ok := rw.(negroni.ResponseWriter); ok && res.Written() {
+				return
+			}
+			if _, ok := context.GetOk(r, "login"); !ok && !wantsJson(r) {
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			writeError(rw, r, fmt.Errorf("panic: %v", err))
+		}
+	}()
+	next(rw, r)
+}
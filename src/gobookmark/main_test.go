@@ -2,18 +2,50 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/codegangsta/negroni"
+	"github.com/mattes/migrate/migrate"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func openTestDatabase() *sql.DB {
+// changeTestSettings changes current settings until restore is called
+func changeTestSettings(change func(s *Settings)) (restore func()) {
+	previous := settings()
+	changeSettings(change)
+	return func() { currentSettings.Store(previous) }
+}
+
+func openTestDatabase() Storage {
 	const test_database = "gobookmark-test.db"
 	const test_bleve = "gobookmark-test.index"
 
@@ -25,9 +57,19 @@ func openTestDatabase() *sql.DB {
 		os.RemoveAll(test_bleve)
 	}
 
-	INDEX = openBleve(test_bleve)
+	index, err := openBleve(test_bleve)
+	checkErr(err)
+	INDEX = index
+
+	db, err := openStorage("sqlite3://" + test_database)
+	checkErr(err)
+	return db
+}
 
-	return openDatabase(test_database)
+func checkErr(err error) {
+	if err != nil {
+		panic(err)
+	}
 }
 
 func TestIndex(t *testing.T) {
@@ -63,6 +105,22 @@ func TestLogin(t *testing.T) {
 	assertResponseBodyContains(t, resp, "Password")
 }
 
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// postForm posts values with the CSRF token of client session
+func postForm(client *http.Client, server_url string, path string, values url.Values) (*http.Response, error) {
+	resp, err := client.Get(server_url + "/login/")
+	if err != nil {
+		return nil, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if match := csrfTokenRegexp.FindStringSubmatch(string(body)); match != nil {
+		values.Set("csrf_token", match[1])
+	}
+	return client.PostForm(server_url+path, values)
+}
+
 func assertResponseBodyContains(t *testing.T, resp *http.Response, contains string) {
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -103,15 +161,19 @@ func TestSaveNewBookmark(t *testing.T) {
 	client := &http.Client{
 		Jar: cookieJar,
 	}
-	client.PostForm(
-		server.URL+"/login/",
+	postForm(
+		client,
+		server.URL,
+		"/login/",
 		url.Values{
 			"password": {"password"},
 		},
 	)
 
-	resp, _ := client.PostForm(
-		server.URL+"/add/",
+	resp, _ := postForm(
+		client,
+		server.URL,
+		"/add/",
 		url.Values{
 			"url":   {"http://cv.stephane-klein.info"},
 			"title": {"Le CV de Stéphane Klein"},
@@ -126,6 +188,60 @@ func TestSaveNewBookmark(t *testing.T) {
 	assertResponseBodyContains(t, resp, "tag2")
 }
 
+func TestSaveInvalidBookmark(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+
+	resp, _ := postForm(
+		client,
+		server.URL,
+		"/add/",
+		url.Values{
+			"url":   {"javascript:alert(1)"},
+			"title": {"Unsafe link"},
+			"tags":  {"tag1,,tag2"},
+		},
+	)
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	assert.Equal(t, resp.Request.URL.Path, "/add/")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "URL must start with http:// or https://")
+	assert.Contains(t, string(body), `value="Unsafe link"`)
+	assert.Contains(t, string(body), `value="tag1,tag2,"`)
+	count, _ := countLinks("")
+	assert.Equal(t, count, 0)
+
+	_, err := insertLink("", "http://example.com", "")
+	assert.Equal(t, errorKind(err), ErrorValidation)
+
+	// Tags are normalized on edit too
+	insertLink("Example", "http://example.com", "")
+	resp, _ = postForm(
+		client,
+		server.URL,
+		"/1/edit/",
+		url.Values{
+			"url":   {"example.com/edited"},
+			"title": {" Edited "},
+			"tags":  {" go ,,go"},
+		},
+	)
+	assert.Equal(t, resp.Request.URL.Path, "/")
+	bookmark, _ := getBookmark(1)
+	assert.Equal(t, bookmark.Title, "Edited")
+	assert.Equal(t, bookmark.Url, "http://example.com/edited")
+	assert.Len(t, bookmark.Tags, 1)
+}
+
 func TestDeleteBookmark(t *testing.T) {
 	DB = openTestDatabase()
 	defer DB.Close()
@@ -137,8 +253,10 @@ func TestDeleteBookmark(t *testing.T) {
 	client := &http.Client{
 		Jar: cookieJar,
 	}
-	client.PostForm(
-		server.URL+"/login/",
+	postForm(
+		client,
+		server.URL,
+		"/login/",
 		url.Values{
 			"password": {"password"},
 		},
@@ -148,6 +266,11 @@ func TestDeleteBookmark(t *testing.T) {
 
 	resp, _ := client.Get(server.URL + "/1/delete/")
 
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, "Curriculum")
+
+	resp, _ = postForm(client, server.URL, "/1/delete/", url.Values{})
+
 	assert.Equal(t, resp.StatusCode, http.StatusOK)
 	assert.Equal(t, resp.Request.URL.Path, "/")
 
@@ -165,8 +288,10 @@ func TestEditBookmark(t *testing.T) {
 	client := &http.Client{
 		Jar: cookieJar,
 	}
-	client.PostForm(
-		server.URL+"/login/",
+	postForm(
+		client,
+		server.URL,
+		"/login/",
 		url.Values{
 			"password": {"password"},
 		},
@@ -179,8 +304,10 @@ func TestEditBookmark(t *testing.T) {
 	assert.Equal(t, resp.StatusCode, http.StatusOK)
 	assertResponseBodyContains(t, resp, "stephane")
 
-	resp, _ = client.PostForm(
-		server.URL+"/1/edit/",
+	resp, _ = postForm(
+		client,
+		server.URL,
+		"/1/edit/",
 		url.Values{
 			"url":   {"http://cv.noelie-deschamps.info"},
 			"title": {"Le CV de Noëlie Deschamps"},
@@ -191,6 +318,40 @@ func TestEditBookmark(t *testing.T) {
 	assertResponseBodyContains(t, resp, "noelie")
 }
 
+func TestErrorResponses(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	assert.Equal(t, errorStatus(notFoundError("Link %d doesn't exist", 42)), http.StatusNotFound)
+	assert.Equal(t, errorStatus(validationError("Title is required")), http.StatusBadRequest)
+	assert.Equal(t, errorStatus(conflictError("Passkey already registered")), http.StatusConflict)
+	assert.Equal(t, errorStatus(errors.New("disk I/O error")), http.StatusInternalServerError)
+	assert.Equal(t, errorMessage(errors.New("disk I/O error")), "Internal Server Error")
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+
+	// Unknown links get an error page instead of a stack trace
+	resp, _ := client.Get(server.URL + "/42/edit/")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	assertResponseBodyContains(t, resp, "404 Not Found")
+
+	resp, _ = client.Get(server.URL + "/abc/delete/")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	// API errors are JSON bodies
+	resp, _ = client.Get(server.URL + "/api/searches/unknown/")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json; charset=utf-8")
+	assert.Equal(t, decodeJsonResponse(resp)["error"], "Saved search unknown doesn't exist")
+}
+
 func TestExtractPageTitle(t *testing.T) {
 	title, _ := extractPageTitle("http://cv.stephane-klein.info")
 	assert.Equal(t, title, "Curriculum vitæ de Stéphane Klein | CV | Développeur, Administrateur Système | 15 ans d'expérience")
@@ -214,16 +375,2176 @@ func TestSearchByTags(t *testing.T) {
 	insertLink("FFFFFFFF", "http://example6.com", "golang")
 	indexAllBookmark()
 
-	total, _ := searchBookmark("[python]", 1, 10)
+	total, _, _, _ := searchBookmark("[python]", 1, 10)
+	assert.Equal(t, total, 4)
+
+	total, _, _, _ = searchBookmark("[golang]", 1, 10)
+	assert.Equal(t, total, 4)
+
+	total, _, _, _ = searchBookmark("[golang][python]", 1, 10)
+	assert.Equal(t, total, 2)
+
+	total, bms, _, _ := searchBookmark("[python] BBBBBBBB", 1, 10)
 	assert.Equal(t, total, 4)
+	assert.Equal(t, bms[0].Title, "BBBBBBBB")
+}
+
+func TestSearchLanguageAnalyzers(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	// Titles without stop words are analyzed with the default language
+	insertLink("Le cheval de course", "http://example1.com", "")
+	insertLink("Cheval", "http://example2.com", "")
+	insertLink("The running horses", "http://example3.com", "")
+	indexAllBookmark()
+
+	total, bms, _, _ := searchBookmark("chevaux", 1, 10)
+	assert.Equal(t, total, 1)
+	assert.Equal(t, bms[0].Title, "Le cheval de course")
+
+	total, bms, _, _ = searchBookmark("runs", 1, 10)
+	assert.Equal(t, total, 1)
+	assert.Equal(t, bms[0].Title, "The running horses")
+}
+
+func TestSearchFacets(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	insertLink("AAAAAAAA", "http://www.example1.com/a", "python")
+	insertLink("BBBBBBBB", "http://example1.com/b", "python,golang")
+	insertLink("CCCCCCCC", "http://example2.com", "golang")
+	indexAllBookmark()
+
+	total, _, facets, _ := searchBookmark("[python]", 1, 10)
+	assert.Equal(t, total, 2)
+	assert.Len(t, facets.Domains, 1)
+	assert.Equal(t, facets.Domains[0].Term, "example1.com")
+	assert.Equal(t, facets.Domains[0].Count, 2)
+	assert.Len(t, facets.Years, 1)
+
+	total, _, _, _ = searchBookmark("domain:example2.com", 1, 10)
+	assert.Equal(t, total, 1)
+
+	// Years of the facet are cached until a link is indexed
+	id, err := DB.ImportLink("DDDDDDDD", "http://example3.com", time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local), nil)
+	assert.Nil(t, err)
+	bm, err := DB.GetBookmark(id)
+	assert.Nil(t, err)
+	assert.Nil(t, indexBookmarkItem(bm))
+	_, _, facets, _ = searchBookmark("", 1, 10)
+	assert.Len(t, facets.Years, 2)
+}
+
+func TestFts5Search(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
 
-	total, _ = searchBookmark("[golang]", 1, 10)
+	search, err := openFts5Search()
+	if err != nil && strings.Contains(err.Error(), "isn't available") {
+		t.Skip("SQLite FTS5 isn't available, run tests with -tags fts5")
+	}
+	assert.Nil(t, err)
+	SEARCH = search
+	defer func() { SEARCH = bleveSearch{} }()
+
+	insertLink("AAAAAAAA", "http://www.example1.com/a", "python")
+	insertLink("BBBBBBBB", "http://example1.com/b", "python")
+	insertLink("CCCCCCCC", "http://example2.com", "python,golang")
+	insertLink("DDDDDDDD", "http://example3.com", "python,golang")
+	insertLink("EEEEEEEE", "http://example4.com", "golang")
+	id, _ := insertLink("FFFFFFFF", "http://example5.com", "golang")
+
+	total, _, _, _ := searchBookmark("[python]", 1, 10)
 	assert.Equal(t, total, 4)
 
-	total, _ = searchBookmark("[golang][python]", 1, 10)
+	total, _, _, _ = searchBookmark("[golang][python]", 1, 10)
 	assert.Equal(t, total, 2)
 
-	total, bms := searchBookmark("[python] BBBBBBBB", 1, 10)
+	total, bms, facets, _ := searchBookmark("[python] BBBBBBBB", 1, 10)
 	assert.Equal(t, total, 4)
 	assert.Equal(t, bms[0].Title, "BBBBBBBB")
+	assert.Equal(t, facets.Domains[0].Term, "example1.com")
+	assert.Equal(t, facets.Domains[0].Count, 2)
+	assert.Len(t, facets.Years, 1)
+
+	total, _, _, _ = searchBookmark("domain:example2.com", 1, 10)
+	assert.Equal(t, total, 1)
+
+	// Triggers keep the table in sync with links and their tags
+	total, _, _, _ = searchBookmark("fffff", 1, 10)
+	assert.Equal(t, total, 1)
+	updateLink(id, "GGGGGGGG", "http://example5.com", "python")
+	total, _, _, _ = searchBookmark("[python] gggg", 1, 10)
+	assert.Equal(t, total, 5)
+	total, _, _, _ = searchBookmark("fffff", 1, 10)
+	assert.Equal(t, total, 0)
+	deleteLink(id)
+	count, _ := SEARCH.Count()
+	assert.Equal(t, count, uint64(5))
+
+	assert.Nil(t, SEARCH.Rebuild(LOG))
+	count, _ = SEARCH.Count()
+	assert.Equal(t, count, uint64(5))
+
+	// Pages are read with LIMIT and OFFSET, facets count every match
+	total, bms, facets, _ = searchBookmark("[python]", 2, 2)
+	assert.Equal(t, total, 4)
+	assert.Len(t, bms, 2)
+	assert.Equal(t, bms[1].Title, "AAAAAAAA")
+	assert.Equal(t, facets.Tags[0].Term, "python")
+	assert.Equal(t, facets.Tags[0].Count, 4)
+	total, _, _, _ = searchBookmark("domain:example1.com year:"+strconv.Itoa(time.Now().Year()), 1, 10)
+	assert.Equal(t, total, 2)
+	total, _, _, _ = searchBookmark("year:2000", 1, 10)
+	assert.Equal(t, total, 0)
+	_, _, _, err = searchBookmark("[python]", 1, -1)
+	assert.Equal(t, errorKind(err), ErrorValidation)
+
+	dropped, err := dropFts5Search()
+	assert.Nil(t, err)
+	assert.True(t, dropped)
+	_, err = SEARCH.Count()
+	assert.NotNil(t, err)
+	dropped, err = dropFts5Search()
+	assert.Nil(t, err)
+	assert.False(t, dropped)
+}
+
+func TestSavedSearch(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	postForm(
+		client,
+		server.URL,
+		"/login/",
+		url.Values{
+			"password": {"password"},
+		},
+	)
+
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+	insertLink("BBBBBBBB", "http://example2.com", "golang")
+	indexAllBookmark()
+
+	resp, _ := postForm(
+		client,
+		server.URL,
+		"/searches/",
+		url.Values{
+			"name":  {"Golang links"},
+			"query": {"[golang]"},
+		},
+	)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Request.URL.Path, "/searches/golang-links/")
+	assertResponseBodyContains(t, resp, "BBBBBBBB")
+	assertResponseBodyNotContains(t, resp, "AAAAAAAA")
+
+	resp, _ = client.Get(server.URL + "/searches/golang-links/rss/")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, "<link>http://example2.com</link>")
+
+	resp, _ = client.Get(server.URL + "/api/searches/golang-links/")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, `"total":1`)
+
+	resp, _ = client.Get(server.URL + "/searches/unknown/")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	// Names without slug and names of another saved search slug are refused
+	resp, _ = postForm(client, server.URL, "/searches/", url.Values{"name": {"!!!"}, "query": {"[golang]"}})
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	resp, _ = postForm(client, server.URL, "/searches/", url.Values{"name": {"Golang Links!"}, "query": {"[python]"}})
+	assert.Equal(t, resp.StatusCode, http.StatusConflict)
+	resp, _ = client.Get(server.URL + "/api/searches/golang-links/")
+	assertResponseBodyContains(t, resp, `"total":1`)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	INDEX.Close()
+	openSwappableBleve("gobookmark-test.index")
+	defer closeSwappableBleve()
+
+	assert.False(t, isIndexStale(currentIndex))
+
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+	total, _, _, _ := searchBookmark("[python]", 1, 10)
+	assert.Equal(t, total, 0)
+
+	err := rebuildIndex(LOG)
+	assert.Nil(t, err)
+
+	total, _, _, _ = searchBookmark("[python]", 1, 10)
+	assert.Equal(t, total, 1)
+	assert.False(t, isIndexStale(currentIndex))
+}
+
+func TestCatchUpPendingIndex(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	id_a, _ := insertLink("AAAAAAAA", "http://example1.com", "python")
+	id_b, _ := insertLink("BBBBBBBB", "http://example2.com", "python")
+	bms, _ := getBookmarks([]int64{id_a, id_b})
+	since, err := DB.CurrentTime()
+	assert.Nil(t, err)
+	setPendingIndex(INDEX)
+	defer setPendingIndex(nil)
+
+	// Links change after the bulk indexation read them, which then writes
+	// them in the pending index
+	updateLink(id_a, "CCCCCCCC", "http://example1.com", "python")
+	deleteLink(id_b)
+	assert.Nil(t, unindexPending(id_b))
+	for _, bm := range bms {
+		INDEX.Index(strconv.FormatInt(bm.Id, 10), newBookmarkDocument(bm))
+	}
+
+	assert.Nil(t, catchUpPendingIndex(INDEX, since))
+	total, bms, _, _ := searchBookmark("[python]", 1, 10)
+	assert.Equal(t, total, 1)
+	assert.Equal(t, bms[0].Title, "CCCCCCCC")
+}
+
+func TestReplaceIndexFiles(t *testing.T) {
+	const filename = "gobookmark-test-swap.index"
+	defer os.RemoveAll(filename)
+	os.RemoveAll(filename)
+	os.MkdirAll(filename, 0700)
+	ioutil.WriteFile(filepath.Join(filename, "old"), []byte{}, 0600)
+	os.MkdirAll(filename+".new", 0700)
+	ioutil.WriteFile(filepath.Join(filename+".new", "new"), []byte{}, 0600)
+
+	assert.Nil(t, replaceIndexFiles(filename+".new", filename))
+	_, err := os.Stat(filepath.Join(filename, "new"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filename + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	// The current index stays in place when the new one can't be moved
+	assert.NotNil(t, replaceIndexFiles(filename+".new", filename))
+	_, err = os.Stat(filepath.Join(filename, "new"))
+	assert.Nil(t, err)
+}
+
+func TestLockIndex(t *testing.T) {
+	const filename = "gobookmark-test-lock.index"
+	defer os.Remove(filename + ".lock")
+
+	assert.Nil(t, lockIndex(filename))
+	defer indexLockFile.Close()
+	// Locks are held by opened files, the lock is refused to another one as
+	// to another process
+	assert.Equal(t, lockIndex(filename), errIndexLocked)
+}
+
+func TestGetBookmarks(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	insertLink("AAAAAAAA", "http://example1.com", "python,golang")
+	insertLink("BBBBBBBB", "http://example2.com", "")
+	insertLink("CCCCCCCC", "http://example3.com", "golang")
+
+	bms, err := getBookmarks([]int64{3, 42, 1})
+	assert.Nil(t, err)
+	assert.Len(t, bms, 2)
+	assert.Equal(t, bms[0].Title, "CCCCCCCC")
+	assert.Len(t, bms[0].Tags, 1)
+	assert.Equal(t, bms[1].Title, "AAAAAAAA")
+	assert.Len(t, bms[1].Tags, 2)
+}
+
+// benchmarkIndexPage renders index page with items_by_page links, its time by
+// link must stay flat as items_by_page grows
+func benchmarkIndexPage(b *testing.B, items_by_page int, search string) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	for i := 0; i < 100; i++ {
+		insertLink(
+			fmt.Sprintf("Link %d", i),
+			fmt.Sprintf("http://example%d.com", i),
+			"python,golang,testing",
+		)
+	}
+	indexAllBookmark()
+	app := initApp()
+
+	values := url.Values{
+		"items_by_page": {strconv.Itoa(items_by_page)},
+		"search":        {search},
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/?"+values.Encode(), nil)
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "http://example") {
+		b.Fatalf("index page status is %d, 200 with links expected", w.Code)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/?"+values.Encode(), nil)
+		app.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkIndexPage10(b *testing.B) {
+	benchmarkIndexPage(b, 10, "")
+}
+
+func BenchmarkIndexPage25(b *testing.B) {
+	benchmarkIndexPage(b, 25, "")
+}
+
+func BenchmarkIndexPage100(b *testing.B) {
+	benchmarkIndexPage(b, 100, "")
+}
+
+func BenchmarkSearchPage10(b *testing.B) {
+	benchmarkIndexPage(b, 10, "[python]")
+}
+
+func BenchmarkSearchPage25(b *testing.B) {
+	benchmarkIndexPage(b, 25, "[python]")
+}
+
+func BenchmarkSearchPage100(b *testing.B) {
+	benchmarkIndexPage(b, 100, "[python]")
+}
+
+func TestCursorPagination(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	for _, title := range []string{"AAAAAAAA", "BBBBBBBB", "CCCCCCCC", "DDDDDDDD", "EEEEEEEE"} {
+		insertLink(title, "http://example.com", "")
+	}
+
+	bms, prev, next, err := queryBookmark(nil, nil, 2, "")
+	assert.Nil(t, err)
+	assert.Len(t, bms, 2)
+	assert.Equal(t, bms[0].Title, "EEEEEEEE")
+	assert.Nil(t, prev)
+	assert.NotNil(t, next)
+
+	// Links inserted meanwhile don't shift next pages
+	insertLink("FFFFFFFF", "http://example.com", "")
+
+	cursor, err := parseCursor(next.String())
+	assert.Nil(t, err)
+	bms, prev, next, _ = queryBookmark(cursor, nil, 2, "")
+	assert.Len(t, bms, 2)
+	assert.Equal(t, bms[0].Title, "CCCCCCCC")
+	assert.Equal(t, bms[1].Title, "BBBBBBBB")
+	assert.NotNil(t, prev)
+
+	bms, _, last, _ := queryBookmark(next, nil, 2, "")
+	assert.Len(t, bms, 1)
+	assert.Equal(t, bms[0].Title, "AAAAAAAA")
+	assert.Nil(t, last)
+
+	bms, prev, _, _ = queryBookmark(nil, prev, 2, "")
+	assert.Len(t, bms, 2)
+	assert.Equal(t, bms[0].Title, "EEEEEEEE")
+	assert.Equal(t, bms[1].Title, "DDDDDDDD")
+	assert.NotNil(t, prev)
+}
+
+func TestLinksFragment(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	insertLink("AAAAAAAA", "http://example1.com", "")
+	insertLink("BBBBBBBB", "http://example2.com", "")
+
+	resp, _ := http.Get(server.URL + "/?items_by_page=1&scroll=infinite")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, "data-infinite-scroll")
+	assertResponseBodyContains(t, resp, "BBBBBBBB")
+
+	_, _, next, _ := queryBookmark(nil, nil, 1, "")
+	resp, _ = http.Get(server.URL + "/?items_by_page=1&fragment=1&after=" + next.String())
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, "AAAAAAAA")
+	assertResponseBodyNotContains(t, resp, "<html>")
+}
+
+func TestItemsByPage(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+	indexAllBookmark()
+
+	for _, path := range []string{"/", "/?search=[python]", "/api/links/"} {
+		for _, items_by_page := range []string{"-2", "-1", "0", "101", "many"} {
+			resp, _ := http.Get(server.URL + path + separator(path) + "items_by_page=" + items_by_page)
+			assert.Equal(t, resp.StatusCode, http.StatusBadRequest, path+" items_by_page="+items_by_page)
+		}
+		resp, _ := http.Get(server.URL + path + separator(path) + "items_by_page=100&page=-1")
+		assert.Equal(t, resp.StatusCode, http.StatusOK, path)
+		assertResponseBodyContains(t, resp, "AAAAAAAA")
+	}
+}
+
+// separator returns the character appending a parameter to path query
+func separator(path string) string {
+	if strings.Contains(path, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+func TestStorePassword(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	defer changeTestSettings(func(s *Settings) {})()
+
+	assert.Nil(t, loadPassword(""))
+	assert.True(t, isDefaultPassword())
+	assert.True(t, checkPassword("password"))
+
+	assert.NotNil(t, storePassword(""))
+	assert.Nil(t, storePassword("s3cr3t"))
+	assert.Nil(t, loadPassword(""))
+	assert.False(t, isDefaultPassword())
+	assert.False(t, checkPassword("password"))
+	assert.True(t, checkPassword("s3cr3t"))
+
+	hash, _ := getSetting(passwordHashSetting)
+	assert.NotContains(t, hash, "s3cr3t")
+
+	assert.Nil(t, loadPassword("from-env"))
+	assert.True(t, checkPassword("from-env"))
+}
+
+func TestSessionKeys(t *testing.T) {
+	const test_secret = "gobookmark-test.secret"
+	os.Remove(test_secret)
+	defer os.Remove(test_secret)
+
+	keys, err := loadSessionKeys(test_secret)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	same_keys, err := loadSessionKeys(test_secret)
+	assert.Nil(t, err)
+	assert.Equal(t, same_keys, keys)
+
+	assert.Nil(t, rotateSessionKeys(test_secret))
+	assert.Nil(t, rotateSessionKeys(test_secret))
+	rotated_keys, err := loadSessionKeys(test_secret)
+	assert.Nil(t, err)
+	assert.Len(t, rotated_keys, sessionKeysKept*2)
+	assert.NotEqual(t, rotated_keys[0], keys[0])
+
+	parsed_keys, err := parseSessionKeys(strings.Replace(formatSessionKeys(rotated_keys), "\n", ",", -1))
+	assert.Nil(t, err)
+	assert.Equal(t, parsed_keys, rotated_keys)
+
+	_, err = parseSessionKeys("abcd")
+	assert.NotNil(t, err)
+}
+
+func TestSessionCookie(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/login/", nil)
+	app.ServeHTTP(w, r)
+
+	cookie := w.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, Session.Name+"=")
+	assert.Contains(t, cookie, "HttpOnly")
+	assert.Contains(t, cookie, "SameSite=Lax")
+}
+
+func TestCsrfProtection(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	postForm(
+		client,
+		server.URL,
+		"/login/",
+		url.Values{
+			"password": {"password"},
+		},
+	)
+
+	insertLink("AAAAAAAA", "http://example1.com", "")
+
+	// Cross-site requests send session cookie but not the CSRF token
+	resp, _ := client.PostForm(server.URL+"/1/delete/", url.Values{})
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = client.PostForm(
+		server.URL+"/add/",
+		url.Values{
+			"url":        {"http://example2.com"},
+			"title":      {"BBBBBBBB"},
+			"csrf_token": {"forged"},
+		},
+	)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	resp, _ = client.PostForm(server.URL+"/login/", url.Values{"password": {"password"}})
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	// GET doesn't delete anymore
+	client.Get(server.URL + "/1/delete/")
+
+	resp, _ = client.Get(server.URL + "/")
+	assertResponseBodyContains(t, resp, "AAAAAAAA")
+	assertResponseBodyNotContains(t, resp, "BBBBBBBB")
+}
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Date(2016, 3, 18, 10, 0, 0, 0, time.UTC)
+	limiter := newLoginLimiter()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		limiter.fail("10.0.0.1")
+		assert.Equal(t, limiter.wait("10.0.0.1"), time.Duration(0))
+	}
+	limiter.fail("10.0.0.1")
+	assert.Equal(t, limiter.wait("10.0.0.1"), time.Second)
+	limiter.fail("10.0.0.1")
+	assert.Equal(t, limiter.wait("10.0.0.1"), 2*time.Second)
+	assert.Equal(t, limiter.wait("10.0.0.2"), time.Duration(0))
+
+	for i := 0; i < 20; i++ {
+		limiter.fail("10.0.0.1")
+	}
+	assert.Equal(t, limiter.wait("10.0.0.1"), limiter.maxLockout)
+
+	now = now.Add(limiter.maxLockout)
+	assert.Equal(t, limiter.wait("10.0.0.1"), time.Duration(0))
+	limiter.success("10.0.0.1")
+	limiter.fail("10.0.0.1")
+	assert.Equal(t, limiter.wait("10.0.0.1"), time.Duration(0))
+
+	// Global throttling applies to all IPs
+	for i := 0; i < limiter.globalFreeAttempts; i++ {
+		limiter.fail(fmt.Sprintf("10.0.1.%d", i))
+	}
+	assert.True(t, limiter.wait("10.0.0.3") > 0)
+
+	now = now.Add(limiter.resetAfter + time.Second)
+	assert.Equal(t, limiter.wait("10.0.0.3"), time.Duration(0))
+
+	// Attempts are reserved when they begin, concurrent ones can't all pass
+	limiter = newLoginLimiter()
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < limiter.freeAttempts; i++ {
+		assert.Equal(t, limiter.begin("10.0.0.4"), time.Duration(0))
+	}
+	assert.Equal(t, limiter.begin("10.0.0.4"), time.Second)
+	limiter.success("10.0.0.4")
+	assert.Equal(t, limiter.begin("10.0.0.4"), time.Duration(0))
+	assert.Equal(t, limiter.global.count, limiter.freeAttempts)
+}
+
+func TestClientIP(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.1, 10.0.0.2")
+	assert.Equal(t, clientIP(r), "127.0.0.1")
+
+	trusted_proxies, _ := parseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	defer changeTestSettings(func(s *Settings) { s.TrustedProxies = trusted_proxies })()
+	assert.Equal(t, clientIP(r), "203.0.113.1")
+
+	r.RemoteAddr = "198.51.100.7:1234"
+	assert.Equal(t, clientIP(r), "198.51.100.7")
+
+	_, err := parseTrustedProxies("not-an-ip")
+	assert.NotNil(t, err)
+}
+
+func TestLoginLockout(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	defer func() { LoginLimiter = newLoginLimiter() }()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	for i := 0; i < LoginLimiter.freeAttempts; i++ {
+		postForm(client, server.URL, "/login/", url.Values{"password": {"wrong"}})
+	}
+
+	resp, _ := postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+	assert.Equal(t, resp.Request.URL.Path, "/login/")
+	assertResponseBodyContains(t, resp, "Too many failed attempts")
+}
+
+func TestImportFile(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+
+	const filename = "gobookmark-test.html"
+	err := ioutil.WriteFile(filename, []byte(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<DL><p>
+	<DT><A HREF="http://example1.com" ADD_DATE="1434542400" TAGS="golang">Example</A>
+	<DT><A HREF="http://example2.com" ADD_DATE="1434542400"></A>
+	<DT><A HREF="javascript:alert(1)" ADD_DATE="1434542400">Script</A>
+	<DT><A HREF="http://example3.com" ADD_DATE="1434542400" TAGS="!!!">Punctuation</A>
+</DL><p>`), 0600)
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+	assert.Nil(t, importFile(filename))
+
+	// Links without title are named by their url, invalid ones are skipped
+	bms, err := DB.BookmarksAfter(0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, bms, 2)
+	titles := make([]string, 0, len(bms))
+	for _, bm := range bms {
+		titles = append(titles, bm.Title)
+	}
+	assert.Equal(t, titles, []string{"Example", "http://example2.com"})
+}
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 SHA1 test vectors, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	assert.Equal(t, totpCode(key, time.Unix(59, 0)), "287082")
+	assert.Equal(t, totpCode(key, time.Unix(1111111109, 0)), "081804")
+	assert.Equal(t, totpCode(key, time.Unix(1234567890, 0)), "005924")
+
+	_, ok := checkTotpCode(key, "287082", time.Unix(59+totpPeriod, 0))
+	assert.True(t, ok)
+	_, ok = checkTotpCode(key, "287082", time.Unix(59+3*totpPeriod, 0))
+	assert.False(t, ok)
+
+	secret, err := generateTotpSecret()
+	assert.Nil(t, err)
+	decoded, err := decodeTotpSecret(secret)
+	assert.Nil(t, err)
+	assert.Len(t, decoded, 20)
+}
+
+func TestLoginTotp(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	now := time.Date(2016, 3, 18, 10, 0, 0, 0, time.UTC)
+	totpNow = func() time.Time { return now }
+	defer func() { totpNow = time.Now }()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	secret, _ := generateTotpSecret()
+	key, _ := decodeTotpSecret(secret)
+	recovery_codes, err := enableTotp(secret)
+	assert.Nil(t, err)
+	assert.Len(t, recovery_codes, recoveryCodesCount)
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+	resp, _ := postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+	assert.Equal(t, resp.Request.URL.Path, "/login/totp/")
+
+	// Password alone doesn't log in
+	resp, _ = client.Get(server.URL + "/add/")
+	assertResponseBodyNotContains(t, resp, "Logout")
+
+	// Logout forgets the pending second factor
+	postForm(client, server.URL, "/logout/", url.Values{})
+	resp, _ = client.Get(server.URL + "/login/totp/")
+	assert.Equal(t, resp.Request.URL.Path, "/login/")
+	resp, _ = postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+	assert.Equal(t, resp.Request.URL.Path, "/login/totp/")
+
+	resp, _ = postForm(client, server.URL, "/login/totp/", url.Values{"code": {"000000"}})
+	assert.Equal(t, resp.Request.URL.Path, "/login/totp/")
+	assertResponseBodyContains(t, resp, "Code invalid")
+
+	resp, _ = postForm(client, server.URL, "/login/totp/", url.Values{"code": {totpCode(key, now)}})
+	assert.Equal(t, resp.Request.URL.Path, "/")
+	assertResponseBodyContains(t, resp, "Logout")
+
+	// Codes can't be replayed, recovery codes are used once
+	check := func(code string) bool {
+		valid, err := checkSecondFactor(code)
+		assert.Nil(t, err)
+		return valid
+	}
+	assert.False(t, check(totpCode(key, now)))
+	assert.True(t, check(strings.ToUpper(recovery_codes[0])))
+	assert.False(t, check(recovery_codes[0]))
+	count, err := countRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Equal(t, count, recoveryCodesCount-1)
+	hashes, err := recoveryCodes()
+	assert.Nil(t, err)
+	for _, hash := range hashes {
+		assert.True(t, strings.HasPrefix(hash, "$2a$"), "recovery codes are hashed with bcrypt")
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+	assert.True(t, check(totpCode(key, now)))
+
+	// Disabling requires a second factor, guessing it is rate limited
+	defer func() { LoginLimiter = newLoginLimiter() }()
+	for i := 0; i < LoginLimiter.freeAttempts; i++ {
+		postForm(client, server.URL, "/totp/disable/", url.Values{"code": {"000000"}})
+	}
+	now = now.Add(totpPeriod * time.Second)
+	resp, _ = postForm(client, server.URL, "/totp/disable/", url.Values{"code": {totpCode(key, now)}})
+	assertResponseBodyContains(t, resp, "Too many failed attempts")
+	enabled, err := isTotpEnabled()
+	assert.Nil(t, err)
+	assert.True(t, enabled)
+
+	// Password, second factor and passkey attempts share the refusal
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/login/totp/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	_, refused := beginLoginAttempt(w, r)
+	assert.Contains(t, refused, "Too many failed attempts")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+// postJson posts v as JSON with the CSRF token of client session in header
+func postJson(client *http.Client, server_url string, path string, v interface{}) (*http.Response, error) {
+	resp, err := client.Get(server_url + "/login/")
+	if err != nil {
+		return nil, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", server_url+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if match := csrfTokenRegexp.FindStringSubmatch(string(body)); match != nil {
+		req.Header.Set(csrfTokenHeader, match[1])
+	}
+	return client.Do(req)
+}
+
+func decodeJsonResponse(resp *http.Response) map[string]interface{} {
+	defer resp.Body.Close()
+	result := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result
+}
+
+// cborPairs is a CBOR map encoded in order by cborEncode
+type cborPairs [][2]interface{}
+
+// cborEncode encodes the subset of CBOR used by authenticators
+func cborEncode(v interface{}) []byte {
+	header := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	switch value := v.(type) {
+	case int:
+		if value < 0 {
+			return header(1, -1-value)
+		}
+		return header(0, value)
+	case []byte:
+		return append(header(2, len(value)), value...)
+	case string:
+		return append(header(3, len(value)), value...)
+	case cborPairs:
+		result := header(5, len(value))
+		for _, pair := range value {
+			result = append(result, cborEncode(pair[0])...)
+			result = append(result, cborEncode(pair[1])...)
+		}
+		return result
+	}
+	panic(fmt.Sprintf("cborEncode doesn't support %T", v))
+}
+
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// softAuthenticator is a software WebAuthn authenticator with a P-256 key
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	origin       string
+}
+
+func newSoftAuthenticator(origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(err)
+	credential_id := make([]byte, 16)
+	_, err = rand.Read(credential_id)
+	checkErr(err)
+	return &softAuthenticator{key: key, credentialId: credential_id, origin: origin}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, err := json.Marshal(webauthnClientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	checkErr(err)
+	return data
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte) []byte {
+	u, err := url.Parse(a.origin)
+	checkErr(err)
+	rp_id_hash := sha256.Sum256([]byte(strings.Split(u.Host, ":")[0]))
+	a.signCount++
+	data := append([]byte{}, rp_id_hash[:]...)
+	data = append(data, flags)
+	data = append(data, byte(a.signCount>>24), byte(a.signCount>>16), byte(a.signCount>>8), byte(a.signCount))
+	return data
+}
+
+// create returns clientDataJSON and attestationObject of a registration
+func (a *softAuthenticator) create(challenge string) map[string]string {
+	auth_data := a.authenticatorData(webauthnUserPresent | webauthnAttestedData)
+	auth_data = append(auth_data, make([]byte, 16)...)
+	auth_data = append(auth_data, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+	auth_data = append(auth_data, a.credentialId...)
+	auth_data = append(auth_data, cborEncode(cborPairs{
+		{coseKeyType, coseKeyTypeEC2},
+		{coseAlgorithm, coseAlgorithmES256},
+		{coseEC2Curve, coseCurveP256},
+		{coseEC2X, paddedBytes(a.key.X, 32)},
+		{coseEC2Y, paddedBytes(a.key.Y, 32)},
+	})...)
+
+	return map[string]string{
+		"id":             encodeBase64Url(a.credentialId),
+		"name":           "Test key",
+		"clientDataJSON": encodeBase64Url(a.clientData("webauthn.create", challenge)),
+		"attestationObject": encodeBase64Url(cborEncode(cborPairs{
+			{"fmt", "none"},
+			{"attStmt", cborPairs{}},
+			{"authData", auth_data},
+		})),
+	}
+}
+
+// get returns an assertion signed by the authenticator
+func (a *softAuthenticator) get(challenge string) map[string]string {
+	client_data_json := a.clientData("webauthn.get", challenge)
+	auth_data := a.authenticatorData(webauthnUserPresent)
+	client_data_hash := sha256.Sum256(client_data_json)
+	signed := sha256.Sum256(append(append([]byte{}, auth_data...), client_data_hash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, signed[:])
+	checkErr(err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	checkErr(err)
+
+	return map[string]string{
+		"id":                encodeBase64Url(a.credentialId),
+		"clientDataJSON":    encodeBase64Url(client_data_json),
+		"authenticatorData": encodeBase64Url(auth_data),
+		"signature":         encodeBase64Url(signature),
+	}
+}
+
+func TestWebAuthn(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+	authenticator := newSoftAuthenticator(server.URL)
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+
+	// Registration requires login
+	resp, _ := postJson(client, server.URL, "/webauthn/register/begin/", nil)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	postForm(client, server.URL, "/login/", url.Values{"password": {"password"}})
+	resp, _ = postJson(client, server.URL, "/webauthn/register/begin/", nil)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	options := decodeJsonResponse(resp)
+	challenge := options["challenge"].(string)
+
+	// Challenge is checked
+	resp, _ = postJson(client, server.URL, "/webauthn/register/finish/", authenticator.create("invalid"))
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+	resp, _ = postJson(client, server.URL, "/webauthn/register/begin/", nil)
+	challenge = decodeJsonResponse(resp)["challenge"].(string)
+	resp, _ = postJson(client, server.URL, "/webauthn/register/finish/", authenticator.create(challenge))
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	credentials, err := queryWebAuthnCredentials()
+	assert.Nil(t, err)
+	assert.Len(t, credentials, 1)
+	assert.Equal(t, credentials[0].Name, "Test key")
+
+	resp, _ = client.Get(server.URL + "/webauthn/")
+	assertResponseBodyContains(t, resp, "Test key")
+
+	// Login with passkey in a new session
+	cookieJar, _ = cookiejar.New(nil)
+	client = &http.Client{
+		Jar: cookieJar,
+	}
+	resp, _ = postJson(client, server.URL, "/login/webauthn/begin/", nil)
+	challenge = decodeJsonResponse(resp)["challenge"].(string)
+	assertion := authenticator.get(challenge)
+	resp, _ = postJson(client, server.URL, "/login/webauthn/finish/", assertion)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, decodeJsonResponse(resp)["redirect"], "/")
+
+	resp, _ = client.Get(server.URL + "/add/")
+	assertResponseBodyContains(t, resp, "Logout")
+	credential, err := getWebAuthnCredential(encodeBase64Url(authenticator.credentialId))
+	assert.Nil(t, err)
+	assert.Equal(t, credential.SignCount, uint32(2))
+
+	// Assertion can't be replayed, challenge is used once
+	resp, _ = postJson(client, server.URL, "/login/webauthn/finish/", assertion)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	// Assertion from another origin is refused
+	phishing := newSoftAuthenticator("http://phishing.example.com")
+	phishing.key = authenticator.key
+	phishing.credentialId = authenticator.credentialId
+	phishing.signCount = authenticator.signCount
+	resp, _ = postJson(client, server.URL, "/login/webauthn/begin/", nil)
+	challenge = decodeJsonResponse(resp)["challenge"].(string)
+	resp, _ = postJson(client, server.URL, "/login/webauthn/finish/", phishing.get(challenge))
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+}
+
+func TestVerifyAssertionSignCount(t *testing.T) {
+	authenticator := newSoftAuthenticator("https://bm.example.com")
+	registration := authenticator.create("challenge")
+	client_data_json, _ := decodeBase64Url(registration["clientDataJSON"])
+	attestation_object, _ := decodeBase64Url(registration["attestationObject"])
+	auth_data, err := verifyRegistration("bm.example.com", "https://bm.example.com", "challenge", client_data_json, attestation_object)
+	assert.Nil(t, err)
+	assert.Equal(t, auth_data.CredentialId, authenticator.credentialId)
+
+	verify := func(assertion map[string]string, sign_count uint32) (uint32, error) {
+		client_data_json, _ := decodeBase64Url(assertion["clientDataJSON"])
+		raw_auth_data, _ := decodeBase64Url(assertion["authenticatorData"])
+		signature, _ := decodeBase64Url(assertion["signature"])
+		return verifyAssertion("bm.example.com", "https://bm.example.com", "challenge", auth_data.PublicKey, sign_count, client_data_json, raw_auth_data, signature)
+	}
+
+	sign_count, err := verify(authenticator.get("challenge"), auth_data.SignCount)
+	assert.Nil(t, err)
+	assert.Equal(t, sign_count, uint32(2))
+
+	// A cloned authenticator sends a counter which doesn't increase
+	authenticator.signCount = 1
+	_, err = verify(authenticator.get("challenge"), sign_count)
+	assert.NotNil(t, err)
+
+	// Tampered authenticator data invalidates signature
+	assertion := authenticator.get("challenge")
+	raw_auth_data, _ := decodeBase64Url(assertion["authenticatorData"])
+	raw_auth_data[36] = 0xff
+	assertion["authenticatorData"] = encodeBase64Url(raw_auth_data)
+	_, err = verify(assertion, 0)
+	assert.NotNil(t, err)
+}
+
+// mockOidcProvider is an OpenID Connect issuer which authorizes every
+// request without user interaction
+type mockOidcProvider struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	subject string
+	groups  []string
+	// codes maps authorization codes to nonce and PKCE challenge
+	codes map[string][2]string
+}
+
+func newMockOidcProvider() *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkErr(err)
+	p := &mockOidcProvider{key: key, subject: "alice", codes: make(map[string][2]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, r, map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, r, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   encodeBase64Url(p.key.N.Bytes()),
+				"e":   encodeBase64Url(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, _ := generateOidcToken()
+		p.codes[code] = [2]string{query.Get("nonce"), query.Get("code_challenge")}
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{
+			"code":  {code},
+			"state": {query.Get("state")},
+		}.Encode(), 302)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		client_id, client_secret, _ := r.BasicAuth()
+		authorization, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || client_id != "gobookmark" || client_secret != "secret" || encodeBase64Url(challenge[:]) != authorization[1] {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		writeJson(w, r, map[string]string{
+			"id_token": p.idToken(map[string]interface{}{
+				"nonce": authorization[0],
+			}),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+// idToken returns a signed ID token, claims override default claims
+func (p *mockOidcProvider) idToken(claims map[string]interface{}) string {
+	payload := map[string]interface{}{
+		"iss":                p.server.URL,
+		"aud":                "gobookmark",
+		"sub":                p.subject,
+		"preferred_username": p.subject,
+		"groups":             p.groups,
+		"iat":                oidcNow().Unix(),
+		"exp":                oidcNow().Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	body, _ := json.Marshal(payload)
+	signed := encodeBase64Url(header) + "." + encodeBase64Url(body)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hashed[:])
+	checkErr(err)
+	return signed + "." + encodeBase64Url(signature)
+}
+
+func TestLoginOidc(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	provider := newMockOidcProvider()
+	defer provider.server.Close()
+	oidc, err := newOidcProvider(OidcConfig{
+		Issuer:        provider.server.URL,
+		ClientId:      "gobookmark",
+		ClientSecret:  "secret",
+		AllowedGroups: []string{"bookmarks"},
+	})
+	assert.Nil(t, err)
+	defer changeTestSettings(func(s *Settings) { s.OIDC = oidc })()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+
+	resp, _ := client.Get(server.URL + "/login/")
+	assertResponseBodyContains(t, resp, "/login/oidc/")
+
+	// Identity outside allowed groups is refused
+	provider.groups = []string{"others"}
+	resp, _ = client.Get(server.URL + "/login/oidc/")
+	assert.Equal(t, resp.Request.URL.Path, "/login/")
+	assertResponseBodyContains(t, resp, "alice isn&#39;t allowed to log in")
+
+	provider.groups = []string{"others", "bookmarks"}
+	resp, _ = client.Get(server.URL + "/login/oidc/")
+	assert.Equal(t, resp.Request.URL.Path, "/")
+	assertResponseBodyContains(t, resp, "Logout")
+
+	// Callback can't be replayed, state is used once
+	cookieJar, _ = cookiejar.New(nil)
+	client = &http.Client{
+		Jar: cookieJar,
+	}
+	resp, _ = client.Get(server.URL + "/login/oidc/callback/?code=replayed&state=")
+	assert.Equal(t, resp.Request.URL.Path, "/login/")
+	assertResponseBodyContains(t, resp, "Single sign-on session expired")
+}
+
+func TestVerifyOidcIdToken(t *testing.T) {
+	provider := newMockOidcProvider()
+	defer provider.server.Close()
+	provider.groups = []string{"bookmarks"}
+	oidc, err := newOidcProvider(OidcConfig{
+		Issuer:          provider.server.URL,
+		ClientId:        "gobookmark",
+		AllowedSubjects: []string{"bob"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, oidc.discover())
+
+	identity, err := oidc.verifyIdToken(provider.idToken(map[string]interface{}{"nonce": "n"}), "n")
+	assert.Nil(t, err)
+	assert.Equal(t, identity.Subject, "alice")
+	assert.Equal(t, identity.Groups, []string{"bookmarks"})
+	assert.False(t, oidc.isAllowed(identity))
+	identity.Subject = "bob"
+	assert.True(t, oidc.isAllowed(identity))
+
+	invalid_tokens := []map[string]interface{}{
+		{"nonce": "other"},
+		{"nonce": "n", "aud": "other-client"},
+		{"nonce": "n", "iss": "https://other.example.com"},
+		{"nonce": "n", "exp": oidcNow().Add(-time.Hour).Unix()},
+	}
+	for _, claims := range invalid_tokens {
+		_, err = oidc.verifyIdToken(provider.idToken(claims), "n")
+		assert.NotNil(t, err, fmt.Sprintf("%v", claims))
+	}
+
+	// Signature of another key is refused
+	token := provider.idToken(map[string]interface{}{"nonce": "n"})
+	provider.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	forged := provider.idToken(map[string]interface{}{"nonce": "n"})
+	parts := strings.Split(token, ".")
+	_, err = oidc.verifyIdToken(parts[0]+"."+parts[1]+"."+strings.Split(forged, ".")[2], "n")
+	assert.NotNil(t, err)
+
+	// Configuration allowing any account of the issuer is refused
+	_, err = newOidcProvider(OidcConfig{Issuer: provider.server.URL, ClientId: "gobookmark"})
+	assert.NotNil(t, err)
+}
+
+func TestProxyHeaderAuthentication(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	defer changeTestSettings(func(s *Settings) { s.AuthHeader = "X-Remote-User" })()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	client := &http.Client{}
+	get := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("X-Remote-User", "alice")
+		resp, _ := client.Do(req)
+		return resp
+	}
+
+	// Header is ignored from untrusted addresses
+	resp := get("/add/")
+	assertResponseBodyNotContains(t, resp, "alice")
+	resp = get("/login/")
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	trusted_proxies, _ := parseTrustedProxies("127.0.0.1")
+	defer changeTestSettings(func(s *Settings) { s.TrustedProxies = trusted_proxies })()
+	resp = get("/add/")
+	assertResponseBodyContains(t, resp, "alice")
+	assertResponseBodyNotContains(t, resp, "Logout")
+
+	// Password login form is skipped
+	resp = get("/login/")
+	assert.Equal(t, resp.Request.URL.Path, "/")
+}
+
+func TestBasePath(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	BasePath = "/bookmarks"
+	defer func() { BasePath = "" }()
+	app := initApp()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: cookieJar,
+	}
+
+	resp, _ := client.Get(server.URL + "/bookmarks")
+	assert.Equal(t, resp.Request.URL.Path, "/bookmarks/")
+	assertResponseBodyContains(t, resp, `href="/bookmarks/css/screen.css"`)
+	assertResponseBodyContains(t, resp, `href="/bookmarks/login/"`)
+
+	resp, _ = postForm(client, server.URL, "/bookmarks/login/", url.Values{"password": {"password"}})
+	assert.Equal(t, resp.Request.URL.Path, "/bookmarks/")
+	assertResponseBodyContains(t, resp, `action="/bookmarks/logout/"`)
+
+	// Facets refine the search under base path
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+	indexAllBookmark()
+	resp, _ = client.Get(server.URL + "/bookmarks/?search=AAAAAAAA")
+	assertResponseBodyContains(t, resp, `href="/bookmarks/?search=AAAAAAAA`)
+
+	// Session cookie is limited to base path
+	u, _ := url.Parse(server.URL + "/")
+	assert.Len(t, cookieJar.Cookies(u), 0)
+
+	// Requests whose prefix was stripped by the proxy are served too
+	resp, _ = client.Get(server.URL + "/css/screen.css")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	const filename = "gobookmark-test.toml"
+	err := ioutil.WriteFile(filename, []byte(`
+[server]
+port = "9000"
+host = "0.0.0.0"
+items_by_page = 50
+
+[storage]
+data = "from-file"
+
+[auth]
+password = "secret"
+
+[auth.oidc]
+issuer = "https://id.example.com"
+client_id = "gobookmark"
+client_secret = "secret"
+allowed_groups = ["bookmarks"]
+`), 0600)
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+
+	os.Setenv("GOBOOKMARK_PORT", "9001")
+	os.Setenv("GOBOOKMARK_DATABASE", "from-env")
+	defer os.Unsetenv("GOBOOKMARK_PORT")
+	defer os.Unsetenv("GOBOOKMARK_DATABASE")
+
+	var config *Config
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		stringFlag("config, c", "", "", ""),
+		stringFlag("data, d", "gobookmark", "", "GOBOOKMARK_DATABASE"),
+	}
+	app.Action = func(c *cli.Context) {
+		config, err = loadConfig(c)
+	}
+	app.Run([]string{"gobookmark", "--config", filename, "-d", "from-flag"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, config.Storage.Data, "from-flag")
+	assert.Equal(t, config.Server.Port, "9001")
+	assert.Equal(t, config.Server.Host, "0.0.0.0")
+	assert.Equal(t, config.Server.ItemsByPage, 50)
+	assert.Equal(t, config.Server.SessionName, "my_session")
+	assert.Equal(t, config.Auth.Oidc.AllowedGroups, []string{"bookmarks"})
+
+	output, err := config.show()
+	assert.Nil(t, err)
+	assert.Contains(t, output, `port = "9001"`)
+	assert.NotContains(t, output, "secret")
+}
+
+func TestConfigValidation(t *testing.T) {
+	config := defaultConfig()
+	assert.Nil(t, config.validate())
+
+	const filename = "gobookmark-test.yaml"
+	err := ioutil.WriteFile(filename, []byte("server:\n  base_path: /bookmarks/\nindexing:\n  language: fr\n"), 0600)
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+	assert.Nil(t, loadConfigFile(config, filename))
+	assert.Nil(t, config.validate())
+	assert.Equal(t, config.Server.BasePath, "/bookmarks")
+	assert.Equal(t, config.Indexing.Language, "fr")
+
+	invalid_configs := []func(config *Config){
+		func(config *Config) { config.Server.Port = "http" },
+		func(config *Config) { config.Server.BasePath = "bookmarks" },
+		func(config *Config) { config.Server.ItemsByPage = 0 },
+		func(config *Config) { config.Server.ItemsByPage = 1000 },
+		func(config *Config) { config.Server.CookieSameSite = "sometimes" },
+		func(config *Config) { config.Server.CookieSameSite = "None" },
+		func(config *Config) { config.Server.SessionName = "my session" },
+		func(config *Config) { config.Auth.Header = "X-Remote-User" },
+		func(config *Config) { config.Server.TlsCert = "cert.pem" },
+		func(config *Config) { config.Server.HttpRedirect = ":8080" },
+		func(config *Config) { config.Server.SocketMode = "0999" },
+		func(config *Config) { config.Auth.Oidc.Issuer = "https://id.example.com" },
+		func(config *Config) { config.Fetcher.Timeout = "10" },
+		func(config *Config) { config.Indexing.Language = "tlh" },
+		func(config *Config) { config.Metrics.Listen = "127.0.0.1:9100" },
+		func(config *Config) { config.Backup.Interval = "24h" },
+		func(config *Config) { config.Backup.Keep = 0 },
+		func(config *Config) {
+			config.Metrics.Enabled = true
+			config.Metrics.Listen = "9100"
+		},
+		func(config *Config) { config.Storage.Database = "mysql://localhost/gobookmark" },
+		func(config *Config) { config.Indexing.Engine = "lucene" },
+		func(config *Config) {
+			config.Storage.Database = "postgres://localhost/gobookmark"
+			config.Indexing.Engine = searchEngineFts5
+		},
+		func(config *Config) {
+			config.Storage.Database = "postgres://localhost/gobookmark"
+			config.Backup.Dir = "backups"
+			config.Backup.Interval = "24h"
+		},
+	}
+	for i, invalidate := range invalid_configs {
+		config := defaultConfig()
+		invalidate(config)
+		assert.NotNil(t, config.validate(), fmt.Sprintf("invalid config %d", i))
+	}
+
+	err = ioutil.WriteFile("gobookmark-test.toml", []byte("[server]\nprot = \"9000\"\n"), 0600)
+	assert.Nil(t, err)
+	defer os.Remove("gobookmark-test.toml")
+	assert.NotNil(t, loadConfigFile(defaultConfig(), "gobookmark-test.toml"))
+}
+
+func TestApplyReloadable(t *testing.T) {
+	defer changeTestSettings(func(s *Settings) {})()
+	previous := settings()
+
+	// Requests keep the settings they read while a reload replaces them
+	config := defaultConfig()
+	config.Server.ItemsByPage = 10
+	config.Auth.Header = "X-Remote-User"
+	config.applyReloadable()
+	assert.Equal(t, settings().ItemsByPage, 10)
+	assert.Equal(t, settings().AuthHeader, "X-Remote-User")
+	assert.Equal(t, previous.ItemsByPage, 25)
+	assert.Equal(t, previous.AuthHeader, "")
+	assert.Nil(t, settings().PasswordHash)
+}
+
+func TestMetrics(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	defer func() { ServeMetrics = false }()
+	ServeMetrics = true
+	app := initApp()
+
+	insertLink("AAAAAAAA", "http://example1.com", "python,golang")
+	insertLink("BBBBBBBB", "http://example2.com", "python")
+	_, _, _, err := searchBookmark("[python]", 1, 10)
+	assert.Nil(t, err)
+
+	request, _ := http.NewRequest("GET", "/searches/unknown/", nil)
+	app.ServeHTTP(httptest.NewRecorder(), request)
+	request, _ = http.NewRequest("BREW", "/", nil)
+	app.ServeHTTP(httptest.NewRecorder(), request)
+
+	// Metrics of the web server require login
+	request, _ = http.NewRequest("GET", "/metrics", nil)
+	request.RemoteAddr = "127.0.0.1:1234"
+	response := httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusForbidden)
+
+	trusted_proxies, _ := parseTrustedProxies("127.0.0.1")
+	defer changeTestSettings(func(s *Settings) {
+		s.AuthHeader = "X-Remote-User"
+		s.TrustedProxies = trusted_proxies
+	})()
+	request.Header.Set("X-Remote-User", "prometheus")
+	response = httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusOK)
+	body := response.Body.String()
+	assert.Contains(t, body, `gobookmark_http_requests_total{method="GET",route="/searches/:slug/",status="404"}`)
+	assert.Contains(t, body, `gobookmark_http_requests_total{method="other",route="other",`)
+	assert.Contains(t, body, `gobookmark_http_request_duration_seconds_count{method="GET",route="/searches/:slug/"}`)
+	assert.Contains(t, body, "gobookmark_bookmarks 2")
+	assert.Contains(t, body, "gobookmark_tags 2")
+	assert.Contains(t, body, "gobookmark_search_duration_seconds_count")
+	assert.Contains(t, body, "gobookmark_sqlite_open_connections")
+
+	// Metrics are only served on their own listener when it's set
+	ServeMetrics = false
+	response = httptest.NewRecorder()
+	initApp().ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = httptest.NewRecorder()
+	metricsServerHandler().ServeHTTP(response, request)
+	assert.Contains(t, response.Body.String(), "gobookmark_bookmarks 2")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	server := httptest.NewServer(initApp())
+	defer server.Close()
+
+	resp, _ := http.Get(server.URL + "/healthz")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, decodeJsonResponse(resp)["status"], "ok")
+
+	resp, _ = http.Get(server.URL + "/readyz")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	result := decodeJsonResponse(resp)
+	assert.Equal(t, result["status"], "ok")
+	checks := result["checks"].(map[string]interface{})
+	migrations := checks["migrations"].(map[string]interface{})
+	assert.Equal(t, migrations["status"], "ok")
+	assert.Equal(t, migrations["version"], migrations["expected_version"])
+	assert.Equal(t, checks["index"].(map[string]interface{})["documents"], float64(0))
+
+	server_url, _ := url.Parse(server.URL)
+	config := defaultConfig()
+	config.Server.Host, config.Server.Port, _ = net.SplitHostPort(server_url.Host)
+	assert.Nil(t, probeReadiness(config, time.Second))
+
+	// Index failures make the instance unready
+	index := INDEX
+	defer func() { INDEX = index }()
+	INDEX = nil
+	resp, _ = http.Get(server.URL + "/readyz")
+	assert.Equal(t, resp.StatusCode, http.StatusServiceUnavailable)
+	result = decodeJsonResponse(resp)
+	assert.Equal(t, result["status"], "unavailable")
+	checks = result["checks"].(map[string]interface{})
+	assert.Equal(t, checks["index"].(map[string]interface{})["error"], "index isn't opened")
+	assert.Equal(t, checks["database"].(map[string]interface{})["status"], "ok")
+	assert.NotNil(t, probeReadiness(config, time.Second))
+}
+
+func TestBackupRestore(t *testing.T) {
+	DB = openTestDatabase()
+	defer func() { DB.Close() }()
+	const archive = "gobookmark-test-backup.tar.gz"
+	defer os.Remove(archive)
+
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+	assert.Nil(t, writeBackup(archive, "gobookmark-test.db"))
+	// Archives aren't overwritten
+	assert.NotNil(t, writeBackup(archive, "gobookmark-test.db"))
+	assert.NotNil(t, writeBackup("gobookmark-test-missing.tar.gz", "gobookmark-missing.db"))
+
+	insertLink("BBBBBBBB", "http://example2.com", "golang")
+	assert.Nil(t, restoreBackup(archive, "gobookmark-test.db", "gobookmark-test.index"))
+	count, err := countLinks("")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+
+	// The index is rebuilt from the restored database
+	index, err := openBleve("gobookmark-test.index")
+	assert.Nil(t, err)
+	documents, err := index.DocCount()
+	assert.Nil(t, err)
+	assert.Equal(t, documents, uint64(1))
+	index.Close()
+
+	assert.NotNil(t, restoreBackup("main_test.go", "gobookmark-test.db", "gobookmark-test.index"))
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobookmark-backups")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	date := time.Date(2016, 3, 18, 10, 15, 50, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		filename := backupFilename(dir, date.Add(time.Duration(i)*24*time.Hour))
+		assert.Nil(t, ioutil.WriteFile(filename, nil, 0600))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "other.tar.gz"), nil, 0600))
+
+	removed, err := pruneBackups(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, []string{backupFilename(dir, date), backupFilename(dir, date.Add(24*time.Hour))})
+	filenames, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, filenames, 3)
+}
+
+func TestMigrations(t *testing.T) {
+	const test_url = "sqlite3://gobookmark-test.db"
+	DB = openTestDatabase()
+	defer func() { DB.Close() }()
+	defer func() {
+		backups, _ := filepath.Glob("gobookmark-test.db.v*" + backupExtension)
+		for _, backup := range backups {
+			os.Remove(backup)
+		}
+	}()
+	latest, err := latestMigrationVersion(test_url)
+	assert.Nil(t, err)
+	insertLink("AAAAAAAA", "http://example1.com", "python")
+
+	var out bytes.Buffer
+	assert.Nil(t, printMigrationsStatus(test_url, &out))
+	assert.Contains(t, out.String(), fmt.Sprintf("Database schema version : %d (latest : %d)", latest, latest))
+	assert.NotContains(t, out.String(), "pending")
+
+	// Dry run prints SQL and leaves the database unchanged
+	out.Reset()
+	previous, err := previousMigrationVersion(test_url)
+	assert.Nil(t, err)
+	assert.Nil(t, migrateDatabase(test_url, previous, true, &out))
+	assert.Contains(t, out.String(), "DROP TABLE webauthn_credentials")
+	version, err := migrate.Version(test_url, "migrations/sqlite3")
+	assert.Nil(t, err)
+	assert.Equal(t, version, latest)
+
+	assert.Nil(t, migrateDatabase(test_url, previous, false, nil))
+	version, err = migrate.Version(test_url, "migrations/sqlite3")
+	assert.Nil(t, err)
+	assert.Equal(t, version, previous)
+	backups, _ := filepath.Glob("gobookmark-test.db.v*" + backupExtension)
+	assert.Len(t, backups, 1)
+
+	out.Reset()
+	assert.Nil(t, printMigrationsStatus(test_url, &out))
+	assert.Contains(t, out.String(), "pending")
+
+	assert.Nil(t, migrateDatabase(test_url, latest, false, nil))
+	count, err := countLinks("")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+	assert.NotNil(t, migrateDatabase(test_url, latest+1, false, nil))
+
+	// Databases migrated by a newer gobookmark are refused
+	db, err := sql.Open("sqlite3", "gobookmark-test.db")
+	assert.Nil(t, err)
+	_, err = db.Exec("INSERT INTO schema_migrations (version) VALUES (?)", latest+1)
+	db.Close()
+	assert.Nil(t, err)
+	_, err = openStorage(test_url)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "newer")
+}
+
+// testStorage checks db implements Storage, it's run against each database
+func testStorage(t *testing.T, db Storage) {
+	assert.Nil(t, db.Ping())
+	count, err := db.CountLinks("")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 0)
+
+	// Links and tags
+	id_a, err := db.InsertLink("AAAAAAAA", "http://example1.com", []string{"python", "web"})
+	assert.Nil(t, err)
+	imported := time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local)
+	id_b, err := db.ImportLink("BBBBBBBB", "http://example2.com", imported, []string{"golang", "Golang"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, id_a, id_b)
+
+	count, err = db.CountLinks("")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 2)
+	count, err = db.CountLinks("python")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+	count, err = db.CountTags()
+	assert.Nil(t, err)
+	assert.Equal(t, count, 3)
+
+	assert.Nil(t, db.UpdateLink(id_a, "CCCCCCCC", "http://example3.com", []string{"python", "web"}))
+	assert.Equal(t, errorKind(db.UpdateLink(id_b+100, "DDDDDDDD", "http://example4.com", []string{"web"})), ErrorNotFound)
+	bm, err := db.GetBookmark(id_a)
+	assert.Nil(t, err)
+	assert.Equal(t, bm.Title, "CCCCCCCC")
+	assert.Equal(t, bm.Url, "http://example3.com")
+	assert.Len(t, bm.Tags, 2)
+	_, err = db.GetBookmark(id_b + 100)
+	assert.Equal(t, errorKind(err), ErrorNotFound)
+
+	// Imported links are updated at their importation
+	now, err := db.CurrentTime()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(now, strconv.Itoa(time.Now().Year())))
+	updated, err := db.UpdatedBookmarks("2000-01-01 00:00:00")
+	assert.Nil(t, err)
+	assert.Len(t, updated, 2)
+	updated, err = db.UpdatedBookmarks("2100-01-01 00:00:00")
+	assert.Nil(t, err)
+	assert.Len(t, updated, 0)
+
+	tags, err := db.LinkTags(id_b)
+	assert.Nil(t, err)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, tags[0].Slug, "golang")
+
+	bms, err := db.GetBookmarks([]int64{id_b, id_a, id_b + 100})
+	assert.Nil(t, err)
+	assert.Len(t, bms, 2)
+	assert.Nil(t, db.LoadLinksTags(bms))
+	for _, bm := range bms {
+		assert.NotEmpty(t, bm.Tags)
+	}
+	bms, err = db.BookmarksAfter(0, 1)
+	assert.Nil(t, err)
+	assert.Len(t, bms, 1)
+	assert.Equal(t, bms[0].Id, id_a)
+	bms, err = db.BookmarksAfter(id_a, 10)
+	assert.Nil(t, err)
+	assert.Len(t, bms, 1)
+	assert.Equal(t, bms[0].Id, id_b)
+
+	// Newest first, then pages around cursors
+	bms, cursors, err := db.QueryBookmarks(nil, nil, 10, "")
+	assert.Nil(t, err)
+	assert.Len(t, bms, 2)
+	assert.Len(t, cursors, 2)
+	assert.Equal(t, bms[0].Id, id_a)
+	assert.Equal(t, bms[1].Id, id_b)
+	assert.Equal(t, bms[1].CreateDate.Year(), 2015)
+	bms, _, err = db.QueryBookmarks(cursors[0], nil, 10, "")
+	assert.Nil(t, err)
+	assert.Len(t, bms, 1)
+	assert.Equal(t, bms[0].Id, id_b)
+	bms, _, err = db.QueryBookmarks(nil, cursors[1], 10, "")
+	assert.Nil(t, err)
+	assert.Len(t, bms, 1)
+	assert.Equal(t, bms[0].Id, id_a)
+	bms, _, err = db.QueryBookmarks(nil, nil, 10, "golang")
+	assert.Nil(t, err)
+	assert.Len(t, bms, 1)
+
+	years, err := db.LinksYears()
+	assert.Nil(t, err)
+	assert.Equal(t, years, []int{time.Now().Year(), 2015})
+
+	assert.Nil(t, db.DeleteLink(id_a))
+	assert.Equal(t, errorKind(db.DeleteLink(id_a)), ErrorNotFound)
+	count, err = db.CountLinks("")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+
+	// Saved searches
+	search_id, err := db.InsertSavedSearch("My search", "#python")
+	assert.Nil(t, err)
+	updated_id, err := db.InsertSavedSearch("My search", "#golang")
+	assert.Nil(t, err)
+	assert.Equal(t, updated_id, search_id)
+	_, err = db.InsertSavedSearch("My search!", "#golang")
+	assert.Equal(t, errorKind(err), ErrorConflict)
+	saved_searches, err := db.SavedSearches()
+	assert.Nil(t, err)
+	assert.Len(t, saved_searches, 1)
+	saved_search, err := db.GetSavedSearch("my-search")
+	assert.Nil(t, err)
+	assert.Equal(t, saved_search.Query, "#golang")
+	assert.Nil(t, db.DeleteSavedSearch("my-search"))
+	assert.Equal(t, errorKind(db.DeleteSavedSearch("my-search")), ErrorNotFound)
+	_, err = db.GetSavedSearch("my-search")
+	assert.Equal(t, errorKind(err), ErrorNotFound)
+
+	// Settings
+	_, err = db.GetSetting("name")
+	assert.Equal(t, errorKind(err), ErrorNotFound)
+	assert.Nil(t, db.SetSetting("name", "value1"))
+	assert.Nil(t, db.SetSetting("name", "value2"))
+	value, err := db.GetSetting("name")
+	assert.Nil(t, err)
+	assert.Equal(t, value, "value2")
+	assert.Nil(t, db.DeleteSetting("name"))
+	_, err = db.GetSetting("name")
+	assert.Equal(t, errorKind(err), ErrorNotFound)
+	for _, c := range []struct {
+		counter  int64
+		advanced bool
+	}{{10, true}, {10, false}, {9, false}, {11, true}} {
+		advanced, err := db.AdvanceSetting("counter", c.counter)
+		assert.Nil(t, err)
+		assert.Equal(t, advanced, c.advanced, "counter %d", c.counter)
+	}
+	value, err = db.GetSetting("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, value, "11")
+
+	// Recovery codes
+	assert.Nil(t, db.ReplaceRecoveryCodes([]string{"hash1", "hash2"}))
+	hashes, err := db.RecoveryCodes()
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 2)
+	for id, hash := range hashes {
+		if hash == "hash1" {
+			used, err := db.DeleteRecoveryCode(id)
+			assert.Nil(t, err)
+			assert.True(t, used)
+			used, err = db.DeleteRecoveryCode(id)
+			assert.Nil(t, err)
+			assert.False(t, used)
+		}
+	}
+	count, err = db.CountRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+
+	// WebAuthn credentials
+	credential := &WebAuthnCredential{CredentialId: "credential", PublicKey: []byte{1, 2, 3}, Name: "key"}
+	assert.Nil(t, db.InsertWebAuthnCredential(credential))
+	assert.NotEqual(t, credential.Id, int64(0))
+	assert.Nil(t, db.UpdateWebAuthnSignCount(credential.Id, 42))
+	stored, err := db.GetWebAuthnCredential("credential")
+	assert.Nil(t, err)
+	assert.Equal(t, stored.PublicKey, []byte{1, 2, 3})
+	assert.Equal(t, stored.SignCount, uint32(42))
+	credentials, err := db.WebAuthnCredentials()
+	assert.Nil(t, err)
+	assert.Len(t, credentials, 1)
+	assert.Nil(t, db.DeleteWebAuthnCredential(credential.Id))
+	assert.Equal(t, errorKind(db.DeleteWebAuthnCredential(credential.Id)), ErrorNotFound)
+	_, err = db.GetWebAuthnCredential("credential")
+	assert.Equal(t, errorKind(err), ErrorNotFound)
+}
+
+func TestSqliteStorage(t *testing.T) {
+	const test_database = "gobookmark-test-storage.db"
+	os.Remove(test_database)
+	defer os.Remove(test_database)
+
+	db, err := openStorage("sqlite3://" + test_database)
+	assert.Nil(t, err)
+	defer db.Close()
+	testStorage(t, db)
+}
+
+// TestPostgresStorage runs against GOBOOKMARK_TEST_POSTGRES database url,
+// in a schema created and dropped by the test
+func TestPostgresStorage(t *testing.T) {
+	database_url := os.Getenv("GOBOOKMARK_TEST_POSTGRES")
+	if database_url == "" {
+		t.Skip("GOBOOKMARK_TEST_POSTGRES isn't set")
+	}
+	// Tables are created in a schema dropped after the test
+	admin, err := sql.Open("postgres", database_url)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("gobookmark_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+	if strings.Contains(database_url, "?") {
+		database_url += "&search_path=" + schema
+	} else {
+		database_url += "?search_path=" + schema
+	}
+
+	db, err := openStorage(database_url)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+	testStorage(t, db)
+}
+
+func TestRebind(t *testing.T) {
+	s := &sqlStorage{numbered: true}
+	assert.Equal(t, s.rebind("SELECT id FROM links WHERE id=? AND title=?"), "SELECT id FROM links WHERE id=$1 AND title=$2")
+	assert.Equal(t, s.rebind("SELECT '?', 'it''s ?' WHERE id=?"), "SELECT '?', 'it''s ?' WHERE id=$1")
+	s.numbered = false
+	assert.Equal(t, s.rebind("SELECT '?' WHERE id=?"), "SELECT '?' WHERE id=?")
+}
+
+func TestGracefulServerDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := newGracefulServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}), time.Second, time.Second)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := http.Get("http://" + listener.Addr().String() + "/")
+		responses <- resp
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.stop(5 * time.Second)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned before in-flight request completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New connections are refused once stopping
+	_, err = net.Dial("tcp", listener.Addr().String())
+	assert.NotNil(t, err)
+
+	close(release)
+	resp := <-responses
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assertResponseBodyContains(t, resp, "done")
+	assert.Nil(t, <-stopped)
+	assert.Nil(t, <-served)
+}
+
+func TestStopBackgroundWorkers(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	defer func() { stopping = make(chan struct{}) }()
+	for i := 0; i < 3; i++ {
+		insertLink("Example", "https://example.com/"+strconv.Itoa(i), "example")
+	}
+
+	iterations := 0
+	goBackground(LOG, "test worker", func(logger *Logger) error {
+		for !isStopping() {
+			iterations++
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+	assert.Nil(t, stopBackgroundWorkers(time.Second))
+	assert.True(t, iterations > 0)
+
+	// Indexation stops between batches
+	assert.Equal(t, indexAllBookmark(), errStopping)
+
+	goBackground(LOG, "stuck worker", func(logger *Logger) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	assert.Equal(t, stopBackgroundWorkers(10*time.Millisecond), errWorkersRunning)
+	backgroundWorkers.Wait()
+}
+
+func TestReloadKeepsRestartSettings(t *testing.T) {
+	previous := defaultConfig()
+	config := defaultConfig()
+	config.Server.Port = "9000"
+	config.Server.ItemsByPage = 50
+	config.Storage.Data = "other"
+	config.Auth.Header = "X-Remote-User"
+
+	names := keepRestartSettings(config, previous)
+	assert.Equal(t, names, []string{"server.port", "storage.data"})
+	assert.Equal(t, config.Server.Port, "8000")
+	assert.Equal(t, config.Storage.Data, "gobookmark")
+	assert.Equal(t, config.Server.ItemsByPage, 50)
+	assert.Equal(t, config.Auth.Header, "X-Remote-User")
+}
+
+func writeTestCertificate(t *testing.T, cert_file string, key_file string, common_name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: common_name},
+		DNSNames:     []string{common_name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	key_der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	assert.Nil(t, err)
+}
+
+func certificateName(t *testing.T, certificate *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Nil(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateLoader(t *testing.T) {
+	const cert_file = "gobookmark-test.crt"
+	const key_file = "gobookmark-test.key"
+	defer os.Remove(cert_file)
+	defer os.Remove(key_file)
+	writeTestCertificate(t, cert_file, key_file, "first.example.com")
+
+	loader, err := newCertificateLoader(cert_file, key_file)
+	assert.Nil(t, err)
+	now := time.Now()
+	loader.now = func() time.Time { return now }
+	loader.checkedAt = now
+
+	// Rotated files are loaded on the next check
+	writeTestCertificate(t, cert_file, key_file, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(cert_file, later, later))
+	assert.Nil(t, os.Chtimes(key_file, later, later))
+	certificate, err := loader.GetCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, certificateName(t, certificate), "first.example.com")
+	now = now.Add(certificateCheckInterval)
+	certificate, _ = loader.GetCertificate(nil)
+	assert.Equal(t, certificateName(t, certificate), "second.example.com")
+
+	// Invalid files keep the previous certificate
+	assert.Nil(t, ioutil.WriteFile(cert_file, []byte("invalid"), 0600))
+	later = later.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(cert_file, later, later))
+	now = now.Add(certificateCheckInterval)
+	certificate, _ = loader.GetCertificate(nil)
+	assert.Equal(t, certificateName(t, certificate), "second.example.com")
+	assert.NotNil(t, loader.reload())
+	_, err = newCertificateLoader(cert_file, key_file)
+	assert.NotNil(t, err)
+}
+
+func TestTlsUnixSocket(t *testing.T) {
+	const cert_file = "gobookmark-test.crt"
+	const key_file = "gobookmark-test.key"
+	const socket = "gobookmark-test.sock"
+	defer os.Remove(cert_file)
+	defer os.Remove(key_file)
+	writeTestCertificate(t, cert_file, key_file, "bm.example.com")
+	defer func() { UnixSocket = false }()
+	UnixSocket = true
+
+	loader, err := newCertificateLoader(cert_file, key_file)
+	assert.Nil(t, err)
+	listener, err := listenUnix(socket, 0600)
+	assert.Nil(t, err)
+	info, err := os.Stat(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+
+	server := newGracefulServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HstsMiddleware(w, r, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "trusted %v", isTrustedPeer(r))
+		})
+	}), time.Second, time.Second)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(tls.NewListener(listener, newTlsConfig(loader)))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://bm.example.com/")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Header.Get("Strict-Transport-Security"), "max-age=15552000")
+	assertResponseBodyContains(t, resp, "trusted true")
+
+	assert.Nil(t, server.stop(time.Second))
+	assert.Nil(t, <-served)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+
+	// Only stale sockets are replaced
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, syscall.Bind(fd, &syscall.SockaddrUnix{Name: socket}))
+	syscall.Close(fd)
+	listener, err = listenUnix(socket, 0600)
+	assert.Nil(t, err)
+	_, err = listenUnix(socket, 0600)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "used by another process")
+	listener.Close()
+
+	assert.Nil(t, ioutil.WriteFile(socket, []byte{}, 0600))
+	defer os.Remove(socket)
+	_, err = listenUnix(socket, 0600)
+	assert.NotNil(t, err)
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	redirects := map[string]string{
+		"443":  "https://bm.example.com/search/?q=go",
+		"8443": "https://bm.example.com:8443/search/?q=go",
+	}
+	for port, location := range redirects {
+		request, _ := http.NewRequest("GET", "http://bm.example.com:8080/search/?q=go", nil)
+		response := httptest.NewRecorder()
+		httpsRedirectHandler(port).ServeHTTP(response, request)
+		assert.Equal(t, response.Code, http.StatusMovedPermanently)
+		assert.Equal(t, response.Header().Get("Location"), location)
+	}
+
+	// HSTS header is sent on HTTPS responses only
+	request, _ := http.NewRequest("GET", "http://bm.example.com/", nil)
+	response := httptest.NewRecorder()
+	HstsMiddleware(response, request, func(w http.ResponseWriter, r *http.Request) {})
+	assert.Equal(t, response.Header().Get("Strict-Transport-Security"), "")
+}
+
+func TestLogger(t *testing.T) {
+	var output bytes.Buffer
+	defer func() {
+		logOutput = os.Stderr
+		logNow = time.Now
+		setLogSettings(LevelInfo, "logfmt")
+	}()
+	logOutput = &output
+	logNow = func() time.Time { return time.Date(2016, 3, 18, 10, 15, 50, 0, time.UTC) }
+
+	logger := LOG.With("request_id", "abc")
+	logger.Debug("hidden")
+	logger.Info("link saved", "id", 42, "title", "Go lang", "error", errors.New("none"))
+	assert.Equal(t, output.String(), "time=2016-03-18T10:15:50Z level=info msg=\"link saved\" request_id=abc id=42 title=\"Go lang\" error=none\n")
+
+	output.Reset()
+	setLogSettings(LevelDebug, "json")
+	logger.Debug("query", "duration", time.Second, "tags", []string{"go"})
+	assert.Equal(t, output.String(), `{"time":"2016-03-18T10:15:50Z","level":"debug","msg":"query","request_id":"abc","duration":"1s","tags":["go"]}`+"\n")
+
+	output.Reset()
+	setLogSettings(LevelWarn, "logfmt")
+	logger.Info("hidden")
+	assert.Equal(t, output.String(), "")
+
+	_, err := parseLogLevel("verbose")
+	assert.NotNil(t, err)
+	level, err := parseLogLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, level, LevelWarn)
+}
+
+func TestAccessLog(t *testing.T) {
+	DB = openTestDatabase()
+	defer DB.Close()
+	var output bytes.Buffer
+	defer func() {
+		logOutput = os.Stderr
+		setLogSettings(LevelInfo, "logfmt")
+	}()
+	logOutput = &output
+	setLogSettings(LevelInfo, "json")
+	app := initApp()
+
+	request, _ := http.NewRequest("GET", "/searches/unknown/", nil)
+	request.RemoteAddr = "127.0.0.1:4321"
+	response := httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusNotFound)
+	request_id := response.Header().Get("X-Request-Id")
+	assert.Equal(t, len(request_id), 16)
+
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal(output.Bytes(), &record))
+	assert.Equal(t, record["msg"], "request")
+	assert.Equal(t, record["request_id"], request_id)
+	assert.Equal(t, record["method"], "GET")
+	assert.Equal(t, record["path"], "/searches/unknown/")
+	assert.Equal(t, record["route"], "/searches/:slug/")
+	assert.Equal(t, record["status"], float64(http.StatusNotFound))
+	assert.Equal(t, record["user"], "")
+	assert.Equal(t, record["ip"], "127.0.0.1")
+
+	// X-Request-Id is kept from trusted proxies only
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "127.0.0.1:4321"
+	request.Header.Set("X-Request-Id", "proxy-id")
+	response = httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.NotEqual(t, response.Header().Get("X-Request-Id"), "proxy-id")
+
+	trusted_proxies, _ := parseTrustedProxies("127.0.0.1")
+	defer changeTestSettings(func(s *Settings) { s.TrustedProxies = trusted_proxies })()
+	response = httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.Equal(t, response.Header().Get("X-Request-Id"), "proxy-id")
+
+	// Panics are logged with the request id and answered with a 500
+	output.Reset()
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/json")
+	response = httptest.NewRecorder()
+	negroni.New(
+		negroni.HandlerFunc(AccessLogMiddleware),
+		negroni.HandlerFunc(RecoveryMiddleware),
+		negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("broken")
+		})),
+	).ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+	assert.Equal(t, strings.TrimSpace(response.Body.String()), `{"error":"Internal Server Error"}`)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, record["msg"], "panic")
+	assert.Equal(t, record["error"], "broken")
+	assert.Equal(t, record["request_id"], response.Header().Get("X-Request-Id"))
+
+	// Panics of the middlewares running before sessions are recovered too
+	request, _ = http.NewRequest("GET", "/", nil)
+	response = httptest.NewRecorder()
+	negroni.New(
+		negroni.HandlerFunc(AccessLogMiddleware),
+		negroni.HandlerFunc(RecoveryMiddleware),
+		negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+			panic("broken middleware")
+		}),
+		negroni.HandlerFunc(GlobalVariableMiddleware),
+	).ServeHTTP(response, request)
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+	assert.Equal(t, strings.TrimSpace(response.Body.String()), "Internal Server Error")
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ServeMetrics is true when /metrics is served by the web server, it's
+// served by its own listener when metrics listen is set
+var ServeMetrics bool
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobookmark",
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		},
+		[]string{"route", "method", "status"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gobookmark",
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP requests latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "method"},
+	)
+	searchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "gobookmark",
+			Name:      "search_duration_seconds",
+			Help:      "Search engine queries latency.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+	titleFetches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobookmark",
+			Name:      "title_fetches_total",
+			Help:      "Page title fetches by result (success or error).",
+		},
+		[]string{"result"},
+	)
+	backgroundWorkerRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobookmark",
+			Name:      "background_workers_total",
+			Help:      "Finished background workers by worker and result (success or error).",
+		},
+		[]string{"worker", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		searchDuration,
+		titleFetches,
+		backgroundWorkerRuns,
+		storageCollector{},
+	)
+}
+
+// routeLabel groups requests which don't match a route, such as static
+// files, so labels stay bounded
+func routeLabel(route string) string {
+	if route == "" {
+		return "other"
+	}
+	return route
+}
+
+// standardMethods are the HTTP methods with their own method label
+var standardMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+// methodLabel groups non standard methods, which clients can choose freely,
+// so labels stay bounded
+func methodLabel(method string) string {
+	if !standardMethods[method] {
+		return "other"
+	}
+	return method
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func observeRequest(route string, method string, status int, elapsed time.Duration) {
+	route = routeLabel(route)
+	method = methodLabel(method)
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+var (
+	bookmarksDesc = prometheus.NewDesc(
+		"gobookmark_bookmarks", "Number of bookmarks.", nil, nil,
+	)
+	tagsDesc = prometheus.NewDesc(
+		"gobookmark_tags", "Number of tags used by bookmarks.", nil, nil,
+	)
+	indexSizeDesc = prometheus.NewDesc(
+		"gobookmark_index_size_bytes", "Size of Bleve index files.", nil, nil,
+	)
+	sqliteOpenConnectionsDesc = prometheus.NewDesc(
+		"gobookmark_sqlite_open_connections", "Open connections of SQLite connection pool.", nil, nil,
+	)
+)
+
+// storageCollector reads database and index gauges when metrics are
+// scraped
+type storageCollector struct{}
+
+func (storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bookmarksDesc
+	ch <- tagsDesc
+	ch <- indexSizeDesc
+	ch <- sqliteOpenConnectionsDesc
+}
+
+func (storageCollector) Collect(ch chan<- prometheus.Metric) {
+	if DB == nil {
+		return
+	}
+	if count, err := countLinks(""); err == nil {
+		ch <- prometheus.MustNewConstMetric(bookmarksDesc, prometheus.GaugeValue, float64(count))
+	} else {
+		LOG.Error("bookmarks metric failed", "error", err)
+	}
+	if count, err := countTags(); err == nil {
+		ch <- prometheus.MustNewConstMetric(tagsDesc, prometheus.GaugeValue, float64(count))
+	} else {
+		LOG.Error("tags metric failed", "error", err)
+	}
+	if indexFilename != "" {
+		if size, err := directorySize(indexFilename); err == nil {
+			ch <- prometheus.MustNewConstMetric(indexSizeDesc, prometheus.GaugeValue, float64(size))
+		} else {
+			LOG.Error("index size metric failed", "error", err)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		sqliteOpenConnectionsDesc,
+		prometheus.GaugeValue,
+		float64(DB.Stats().OpenConnections),
+	)
+}
+
+// directorySize returns the size of files under path
+func directorySize(path string) (size int64, err error) {
+	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+var metricsHandler = prometheus.Handler()
+
+// Metrics serves metrics in Prometheus text format to logged in users,
+// metrics listen serves them without login
+func Metrics(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		http.Error(w, "Login required", http.StatusForbidden)
+		return
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// metricsServerHandler serves /metrics alone, on metrics listen address
+func metricsServerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	return mux
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mattes/migrate/file"
+	"github.com/mattes/migrate/migrate"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is a bundled schema migration, Up and Down are asset names of
+// its SQL files
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+func useMigrationsStore() {
+	migrate.NonGraceful()
+	migrate.UseStore(file.AssetStore{
+		Asset:    Asset,
+		AssetDir: AssetDir,
+	})
+}
+
+// migrationsDir returns the assets directory of database url migrations,
+// migrations/<scheme>
+func migrationsDir(database_url string) string {
+	return "migrations/" + storageScheme(database_url)
+}
+
+// bundledMigrations returns the migrations of database url, sorted by
+// version
+func bundledMigrations(database_url string) ([]*Migration, error) {
+	dir := migrationsDir(database_url)
+	names, err := AssetDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	by_version := make(map[uint64]*Migration)
+	for _, name := range names {
+		parts := strings.SplitN(name, ".", 2)
+		version, err := strconv.ParseUint(strings.SplitN(parts[0], "_", 2)[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s has no version", name)
+		}
+		m, ok := by_version[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[0]}
+			by_version[version] = m
+		}
+		switch parts[1] {
+		case "up.sql":
+			m.Up = dir + "/" + name
+		case "down.sql":
+			m.Down = dir + "/" + name
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(by_version))
+	for _, m := range by_version {
+		migrations = append(migrations, m)
+	}
+	sort.Sort(migrationsByVersion(migrations))
+	return migrations, nil
+}
+
+type migrationsByVersion []*Migration
+
+func (s migrationsByVersion) Len() int           { return len(s) }
+func (s migrationsByVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s migrationsByVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+
+// latestMigrationVersion returns the version of the last bundled migration
+// of database url
+func latestMigrationVersion(database_url string) (uint64, error) {
+	migrations, err := bundledMigrations(database_url)
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// checkSchemaVersion refuses databases migrated by a newer gobookmark,
+// this one doesn't know their schema
+func checkSchemaVersion(version uint64, latest uint64) error {
+	if version > latest {
+		return fmt.Errorf(
+			"database schema version %d is newer than the latest one supported by this gobookmark (%d), upgrade gobookmark",
+			version, latest,
+		)
+	}
+	return nil
+}
+
+// migrationSteps returns the migrations to apply, in order, to go from
+// version to target, and whether they go down
+func migrationSteps(migrations []*Migration, version uint64, target uint64) (steps []*Migration, down bool, err error) {
+	known := target == 0
+	for _, m := range migrations {
+		if m.Version == target {
+			known = true
+		}
+		if target > version && m.Version > version && m.Version <= target {
+			steps = append(steps, m)
+		}
+		if target < version && m.Version > target && m.Version <= version {
+			steps = append([]*Migration{m}, steps...)
+		}
+	}
+	if !known {
+		return nil, false, fmt.Errorf("migration %d doesn't exist", target)
+	}
+	return steps, target < version, nil
+}
+
+// preMigrationBackupFilename returns the name of the backup written before
+// migrating filename SQLite database from version
+func preMigrationBackupFilename(filename string, version uint64, date time.Time) string {
+	return fmt.Sprintf("%s.v%d-%s%s", filename, version, date.Format("20060102T150405"), backupExtension)
+}
+
+// migrateDatabase migrates database url to target version. SQLite databases
+// with data are backed up before. With dry_run, SQL of the migrations is
+// written to out instead.
+func migrateDatabase(database_url string, target uint64, dry_run bool, out io.Writer) error {
+	useMigrationsStore()
+	migrations, err := bundledMigrations(database_url)
+	if err != nil {
+		return err
+	}
+	latest, err := latestMigrationVersion(database_url)
+	if err != nil {
+		return err
+	}
+	version, err := migrate.Version(database_url, migrationsDir(database_url))
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(version, latest); err != nil {
+		return err
+	}
+	steps, down, err := migrationSteps(migrations, version, target)
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	if dry_run {
+		for _, m := range steps {
+			name := m.Up
+			if down {
+				name = m.Down
+			}
+			sql, err := Asset(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "-- %s\n%s\n", filepath.Base(name), strings.TrimSpace(string(sql)))
+		}
+		return nil
+	}
+
+	filename, is_sqlite := sqliteFilename(database_url)
+	if is_sqlite && version > 0 {
+		backup_filename := preMigrationBackupFilename(filename, version, time.Now())
+		if err := writeBackup(backup_filename, filename); err != nil {
+			return fmt.Errorf("backup before migration failed : %v", err)
+		}
+		LOG.Info("database backed up before migration", "file", backup_filename, "version", version, "target_version", target)
+	}
+	relative_n := len(steps)
+	if down {
+		relative_n = -relative_n
+	}
+	errors, ok := migrate.MigrateSync(database_url, migrationsDir(database_url), relative_n)
+	if !ok {
+		return fmt.Errorf("%s database migration failed : %v", redactedUrl(database_url), errors)
+	}
+	return nil
+}
+
+// printMigrationsStatus writes database url version and the state of each
+// bundled migration to out
+func printMigrationsStatus(database_url string, out io.Writer) error {
+	if filename, ok := sqliteFilename(database_url); ok {
+		if _, err := os.Stat(filename); err != nil {
+			return err
+		}
+	}
+	useMigrationsStore()
+	migrations, err := bundledMigrations(database_url)
+	if err != nil {
+		return err
+	}
+	latest, err := latestMigrationVersion(database_url)
+	if err != nil {
+		return err
+	}
+	version, err := migrate.Version(database_url, migrationsDir(database_url))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Database schema version : %d (latest : %d)\n", version, latest)
+	for _, m := range migrations {
+		state := "pending"
+		if m.Version <= version {
+			state = "applied"
+		}
+		fmt.Fprintf(out, "  %-8s %s\n", state, m.Name)
+	}
+	return checkSchemaVersion(version, latest)
+}
+
+// previousMigrationVersion returns the version database url has once its
+// last migration is reverted
+func previousMigrationVersion(database_url string) (uint64, error) {
+	useMigrationsStore()
+	migrations, err := bundledMigrations(database_url)
+	if err != nil {
+		return 0, err
+	}
+	version, err := migrate.Version(database_url, migrationsDir(database_url))
+	if err != nil {
+		return 0, err
+	}
+	previous := uint64(0)
+	for _, m := range migrations {
+		if m.Version < version {
+			previous = m.Version
+		}
+	}
+	return previous, nil
+}
@@ -0,0 +1,5 @@
+DROP INDEX fk_tags_slug;
+DROP INDEX fk_links_tags;
+DROP TABLE rel_links_tags;
+DROP TABLE tags;
+DROP TABLE links;
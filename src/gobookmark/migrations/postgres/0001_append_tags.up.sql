@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS links (
+    id BIGSERIAL PRIMARY KEY,
+    title TEXT NOT NULL,
+    url TEXT NOT NULL,
+    createdate TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+    id BIGSERIAL PRIMARY KEY,
+    title TEXT NOT NULL,
+    slug TEXT NOT NULL
+);
+CREATE INDEX fk_tags_slug ON tags (slug);
+
+CREATE TABLE IF NOT EXISTS rel_links_tags (
+    link_id BIGINT NOT NULL,
+    tag_id BIGINT NOT NULL
+);
+
+CREATE INDEX fk_links_tags ON rel_links_tags (link_id, tag_id);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    query TEXT NOT NULL,
+    createdate TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+);
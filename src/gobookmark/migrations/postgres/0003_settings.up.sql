@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS settings (
+    name TEXT PRIMARY KEY NOT NULL,
+    value TEXT NOT NULL
+);
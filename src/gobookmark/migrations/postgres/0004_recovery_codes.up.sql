@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    hash TEXT NOT NULL
+);
+CREATE INDEX fk_recovery_codes_hash ON recovery_codes (hash);
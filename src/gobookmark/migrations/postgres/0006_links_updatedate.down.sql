@@ -0,0 +1,2 @@
+DROP INDEX links_updatedate;
+ALTER TABLE links DROP COLUMN updatedate;
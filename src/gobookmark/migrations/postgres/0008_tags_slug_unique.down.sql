@@ -0,0 +1,2 @@
+ALTER TABLE tags DROP CONSTRAINT tags_slug_key;
+CREATE INDEX fk_tags_slug ON tags (slug);
@@ -0,0 +1,13 @@
+-- Tags with the same slug are merged into the oldest one
+UPDATE rel_links_tags SET tag_id = (
+    SELECT MIN(same_slug.id) FROM tags JOIN tags AS same_slug ON same_slug.slug = tags.slug
+    WHERE tags.id = rel_links_tags.tag_id
+);
+DELETE FROM rel_links_tags AS duplicate USING rel_links_tags
+    WHERE duplicate.link_id = rel_links_tags.link_id
+    AND duplicate.tag_id = rel_links_tags.tag_id
+    AND duplicate.ctid > rel_links_tags.ctid;
+DELETE FROM tags WHERE id NOT IN (SELECT MIN(id) FROM tags GROUP BY slug);
+
+DROP INDEX fk_tags_slug;
+ALTER TABLE tags ADD CONSTRAINT tags_slug_key UNIQUE (slug);
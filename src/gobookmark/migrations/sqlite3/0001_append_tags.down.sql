@@ -1,4 +1,4 @@
-DROP INDEX links;
+DROP INDEX fk_tags_slug;
 DROP INDEX fk_links_tags;
 DROP TABLE rel_links_tags;
 DROP TABLE tags;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    query TEXT NOT NULL,
+    createdate DATE DEFAULT (datetime('now','localtime'))
+);
@@ -0,0 +1,2 @@
+DROP INDEX fk_recovery_codes_hash;
+DROP TABLE recovery_codes;
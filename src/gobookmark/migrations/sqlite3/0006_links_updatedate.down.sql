@@ -0,0 +1,10 @@
+DROP INDEX links_updatedate;
+CREATE TABLE links_without_updatedate (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    title TEXT NOT NULL,
+    url TEXT NOT NULL,
+    createdate DATE DEFAULT (datetime('now','localtime'))
+);
+INSERT INTO links_without_updatedate (id, title, url, createdate) SELECT id, title, url, createdate FROM links;
+DROP TABLE links;
+ALTER TABLE links_without_updatedate RENAME TO links;
@@ -0,0 +1,3 @@
+ALTER TABLE links ADD COLUMN updatedate DATE;
+UPDATE links SET updatedate = createdate;
+CREATE INDEX links_updatedate ON links (updatedate);
@@ -0,0 +1 @@
+DROP INDEX links_createdate_id;
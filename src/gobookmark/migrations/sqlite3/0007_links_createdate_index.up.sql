@@ -0,0 +1 @@
+CREATE INDEX links_createdate_id ON links (createdate, id);
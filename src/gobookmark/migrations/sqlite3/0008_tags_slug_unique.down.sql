@@ -0,0 +1,2 @@
+DROP INDEX tags_slug;
+CREATE INDEX fk_tags_slug ON tags (slug);
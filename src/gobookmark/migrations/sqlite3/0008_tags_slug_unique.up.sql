@@ -0,0 +1,12 @@
+-- Tags with the same slug are merged into the oldest one
+UPDATE rel_links_tags SET tag_id = (
+    SELECT MIN(same_slug.id) FROM tags JOIN tags AS same_slug ON same_slug.slug = tags.slug
+    WHERE tags.id = rel_links_tags.tag_id
+);
+DELETE FROM rel_links_tags WHERE rowid NOT IN (
+    SELECT MIN(rowid) FROM rel_links_tags GROUP BY link_id, tag_id
+);
+DELETE FROM tags WHERE id NOT IN (SELECT MIN(id) FROM tags GROUP BY slug);
+
+DROP INDEX fk_tags_slug;
+CREATE UNIQUE INDEX tags_slug ON tags (slug);
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/base64"
+	"fmt"
 	"github.com/blevesearch/bleve"
+	_ "github.com/blevesearch/bleve/analysis/analyzers/keyword_analyzer"
+	_ "github.com/blevesearch/bleve/analysis/language/de"
+	_ "github.com/blevesearch/bleve/analysis/language/en"
+	_ "github.com/blevesearch/bleve/analysis/language/fr"
 	"github.com/extemporalgenome/slug"
-	_ "github.com/mattes/migrate/driver/sqlite3"
-	"github.com/mattes/migrate/file"
-	"github.com/mattes/migrate/migrate"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -16,324 +17,425 @@ import (
 )
 
 var (
-	DB    *sql.DB
+	DB    Storage
 	INDEX bleve.Index
 )
 
 type Tag struct {
-	Id    int64
-	Title string
-	Slug  string
+	Id    int64  `json:"id"`
+	Title string `json:"title"`
+	Slug  string `json:"slug"`
 }
 
 type BookmarkItem struct {
-	Id         int64
-	Url        string
-	Title      string
-	CreateDate time.Time
-	Tags       []*Tag
-}
-
-func countLinks(tags string) int {
-	var count int
-	if tags != "" {
-		err := DB.QueryRow(
-			`SELECT
-				COUNT(links.id)
-			FROM
-				links
-			LEFT JOIN
-				rel_links_tags
-			ON
-				rel_links_tags.link_id = links.id
-			LEFT JOIN
-				tags
-			ON
-				rel_links_tags.tag_id = tags.id
-			WHERE
-				tags.slug IN (?)`, tags).Scan(&count)
-		checkErr(err)
-	} else {
-		err := DB.QueryRow("SELECT COUNT(id) FROM links").Scan(&count)
-		checkErr(err)
-	}
-	return count
-}
-
-func openDatabase(filename string) *sql.DB {
-	migrate.NonGraceful()
-	migrate.UseStore(file.AssetStore{
-		Asset:    Asset,
-		AssetDir: AssetDir,
-	})
-	errors, ok := migrate.UpSync("sqlite3://"+filename, "migrations")
-	if !ok {
-		log.Fatalf("%v", errors)
-	}
+	Id         int64     `json:"id"`
+	Url        string    `json:"url"`
+	Title      string    `json:"title"`
+	CreateDate time.Time `json:"createdate"`
+	Tags       []*Tag    `json:"tags"`
+}
 
-	db, err := sql.Open("sqlite3", filename)
-	checkErr(err)
+type SavedSearch struct {
+	Id         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Slug       string    `json:"slug"`
+	Query      string    `json:"query"`
+	CreateDate time.Time `json:"createdate"`
+}
 
-	return db
+type WebAuthnCredential struct {
+	Id           int64
+	CredentialId string
+	PublicKey    []byte
+	SignCount    uint32
+	Name         string
+	CreateDate   time.Time
 }
 
-func indexBookmarkItem(item *BookmarkItem) error {
-	x := struct {
-		Id    int64  `json:"id"`
-		Url   string `json:"url"`
-		Title string `json:"title"`
-		Tags  string `json:"tags"`
-	}{
-		Id:    item.Id,
-		Url:   item.Url,
-		Title: item.Title,
-		Tags:  "",
+type Facet struct {
+	Term  string
+	Count int
+}
+
+type SearchFacets struct {
+	Tags    []*Facet
+	Domains []*Facet
+	Years   []*Facet
+}
+
+// bookmarkDocument is the document indexed in Bleve for each link
+type bookmarkDocument struct {
+	Id         int64     `json:"id"`
+	Url        string    `json:"url"`
+	Domain     string    `json:"domain"`
+	Title      string    `json:"title"`
+	Lang       string    `json:"lang"`
+	Tags       []string  `json:"tags"`
+	CreateDate time.Time `json:"createdate"`
+}
+
+func (d *bookmarkDocument) Type() string {
+	return "link_" + d.Lang
+}
+
+func countLinks(tags string) (int, error) {
+	return DB.CountLinks(tags)
+}
+
+// countTags counts tags used by at least one link
+func countTags() (int, error) {
+	return DB.CountTags()
+}
+
+func urlDomain(raw_url string) string {
+	u, err := url.Parse(raw_url)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+}
+
+func newBookmarkDocument(item *BookmarkItem) *bookmarkDocument {
+	x := &bookmarkDocument{
+		Id:         item.Id,
+		Url:        item.Url,
+		Domain:     urlDomain(item.Url),
+		Title:      item.Title,
+		Lang:       detectLanguage(item.Title),
+		Tags:       make([]string, 0, len(item.Tags)),
+		CreateDate: item.CreateDate,
 	}
 	for _, t := range item.Tags {
-		x.Tags = x.Tags + " " + t.Slug
+		x.Tags = append(x.Tags, t.Slug)
 	}
-	return INDEX.Index(strconv.FormatInt(item.Id, 10), x)
+	return x
+}
+
+// indexBookmarkItem updates item in the search engine
+func indexBookmarkItem(item *BookmarkItem) error {
+	return SEARCH.Index(item)
+}
+
+func unindexBookmarkItem(id int64) error {
+	return SEARCH.Unindex(id)
 }
 
-func indexAllBookmark() {
-	rows, err := DB.Query("SELECT id, title, url, createdate FROM links")
-	checkErr(err)
-	defer rows.Close()
+func indexAllBookmark() error {
+	return indexAllBookmarkInto(INDEX)
+}
 
-	for rows.Next() {
-		bm := new(BookmarkItem)
+// indexBatchSize is the number of links indexed by batch
+var indexBatchSize = 100
 
-		err := rows.Scan(&bm.Id, &bm.Title, &bm.Url, &bm.CreateDate)
-		checkErr(err)
+// indexAllBookmarkInto reads links by pages of indexBatchSize, each page is
+// indexed as one batch. It stops between batches when gobookmark is stopping.
+func indexAllBookmarkInto(index bleve.Index) error {
+	defer clearLinksYears()
+	batch_size := indexBatchSize
 
-		bm.Tags = getLinksTags(bm.Id)
+	var after_id int64
+	for {
+		if isStopping() {
+			return errStopping
+		}
+		bms, err := DB.BookmarksAfter(after_id, batch_size)
+		if err != nil {
+			return err
+		}
+		if len(bms) == 0 {
+			return nil
+		}
+		if err := DB.LoadLinksTags(bms); err != nil {
+			return err
+		}
 
-		indexBookmarkItem(bm)
+		batch := index.NewBatch()
+		for _, bm := range bms {
+			err = batch.Index(strconv.FormatInt(bm.Id, 10), newBookmarkDocument(bm))
+			if err != nil {
+				return err
+			}
+		}
+		if err := index.Batch(batch); err != nil {
+			return err
+		}
+		after_id = bms[len(bms)-1].Id
 	}
 }
 
-func openBleve(filename string) (index bleve.Index) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		indexMapping := bleve.NewIndexMapping()
-		linkMapping := bleve.NewDocumentMapping()
+func newLinkMapping(lang string) *bleve.DocumentMapping {
+	linkMapping := bleve.NewDocumentMapping()
 
-		linkTitleFieldMapping := bleve.NewTextFieldMapping()
-		linkTitleFieldMapping.Analyzer = "en"
-		linkMapping.AddFieldMappingsAt("title", linkTitleFieldMapping)
+	linkTitleFieldMapping := bleve.NewTextFieldMapping()
+	linkTitleFieldMapping.Analyzer = lang
+	linkMapping.AddFieldMappingsAt("title", linkTitleFieldMapping)
 
-		linkUrlFieldMapping := bleve.NewTextFieldMapping()
-		linkMapping.AddFieldMappingsAt("url", linkUrlFieldMapping)
+	linkUrlFieldMapping := bleve.NewTextFieldMapping()
+	linkMapping.AddFieldMappingsAt("url", linkUrlFieldMapping)
 
-		linkTagsFieldMapping := bleve.NewTextFieldMapping()
-		linkMapping.AddFieldMappingsAt("tags", linkTagsFieldMapping)
+	linkDomainFieldMapping := bleve.NewTextFieldMapping()
+	linkDomainFieldMapping.Analyzer = "keyword"
+	linkMapping.AddFieldMappingsAt("domain", linkDomainFieldMapping)
 
-		indexMapping.AddDocumentMapping("link", linkMapping)
+	linkLangFieldMapping := bleve.NewTextFieldMapping()
+	linkLangFieldMapping.Analyzer = "keyword"
+	linkMapping.AddFieldMappingsAt("lang", linkLangFieldMapping)
 
-		index, err = bleve.New(filename, indexMapping)
-		checkErr(err)
-	} else {
-		index, err = bleve.Open(filename)
-		checkErr(err)
-	}
+	linkTagsFieldMapping := bleve.NewTextFieldMapping()
+	linkTagsFieldMapping.Analyzer = "keyword"
+	linkMapping.AddFieldMappingsAt("tags", linkTagsFieldMapping)
+
+	linkCreateDateFieldMapping := bleve.NewDateTimeFieldMapping()
+	linkMapping.AddFieldMappingsAt("createdate", linkCreateDateFieldMapping)
 
-	return index
+	return linkMapping
+}
+
+// newIndexMapping registers one "link_<lang>" document mapping by supported
+// language, each one analyzes title with its language analyzer
+func newIndexMapping() *bleve.IndexMapping {
+	indexMapping := bleve.NewIndexMapping()
+	for _, lang := range supportedLanguages() {
+		indexMapping.AddDocumentMapping("link_"+lang, newLinkMapping(lang))
+	}
+	return indexMapping
 }
 
-func getOrCreateTag(tag_name string) int64 {
-	var id int64
-	stmt, err := DB.Prepare("SELECT id FROM tags WHERE title=?")
-	checkErr(err)
+func openBleve(filename string) (bleve.Index, error) {
+	clearLinksYears()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return bleve.Open(filename)
+	}
 
-	rows, err := stmt.Query(tag_name)
-	defer rows.Close()
-	if rows.Next() {
-		rows.Scan(&id)
-	} else {
-		stmt, err = DB.Prepare("INSERT INTO tags (title, slug) VALUES(?, ?)")
-		checkErr(err)
-		res, err := stmt.Exec(tag_name, slug.Slug(tag_name))
-		id, err = res.LastInsertId()
-		checkErr(err)
+	index, err := bleve.New(filename, newIndexMapping())
+	if err != nil {
+		return nil, err
+	}
+	if err := setIndexMappingVersion(index); err != nil {
+		index.Close()
+		return nil, err
 	}
-	return id
+	return index, nil
 }
 
-func insertLink(title string, url string, tags string) (id int64) {
-	stmt, err := DB.Prepare("INSERT INTO links (title, url) VALUES(?, ?)")
-	checkErr(err)
+// insertLink validates and normalizes link fields before inserting it
+func insertLink(title string, url string, tags string) (id int64, err error) {
+	link, err := validateLink(title, url, tags)
+	if err != nil {
+		return 0, err
+	}
+	return saveLink(0, link)
+}
 
-	res, err := stmt.Exec(title, url)
-	checkErr(err)
-	link_id, err := res.LastInsertId()
-	checkErr(err)
-	updateLinksTags(link_id, strings.Split(tags, ","))
-	return link_id
+func updateLink(id int64, title string, url string, tags string) error {
+	link, err := validateLink(title, url, tags)
+	if err != nil {
+		return err
+	}
+	_, err = saveLink(id, link)
+	return err
 }
 
-func updateLink(id int64, title string, url string, tags string) {
-	stmt, err := DB.Prepare("UPDATE links SET title=?, url=? WHERE id=?")
-	checkErr(err)
+// saveLink inserts link when id is 0, updates id link otherwise. link must
+// be returned by validateLink.
+func saveLink(id int64, link *LinkInput) (int64, error) {
+	if id == 0 {
+		return DB.InsertLink(link.Title, link.Url, link.Tags)
+	}
+	return id, DB.UpdateLink(id, link.Title, link.Url, link.Tags)
+}
 
-	_, err = stmt.Exec(title, url, id)
+func deleteLink(id int64) error {
+	return DB.DeleteLink(id)
+}
 
-	updateLinksTags(id, strings.Split(tags, ","))
+func getLinksTags(link_id int64) ([]*Tag, error) {
+	return DB.LinkTags(link_id)
 }
 
-func updateLinksTags(link_id int64, tag_name_list []string) {
-	stmt, err := DB.Prepare("DELETE FROM rel_links_tags WHERE link_id=?")
-	checkErr(err)
-	_, err = stmt.Exec(link_id)
-	checkErr(err)
+// getBookmarks returns bookmarks with their tags in ids order. Unknown ids
+// are skipped.
+func getBookmarks(ids []int64) ([]*BookmarkItem, error) {
+	found, err := DB.GetBookmarks(ids)
+	if err != nil {
+		return nil, err
+	}
+	bms_by_id := make(map[int64]*BookmarkItem, len(found))
+	for _, bm := range found {
+		bms_by_id[bm.Id] = bm
+	}
 
-	for _, tag_name := range tag_name_list {
-		tag_id := getOrCreateTag(tag_name)
-		stmt, err = DB.Prepare("INSERT INTO rel_links_tags (link_id, tag_id) VALUES(?, ?)")
-		_, err = stmt.Exec(link_id, tag_id)
-		checkErr(err)
+	bms := make([]*BookmarkItem, 0, len(ids))
+	for _, id := range ids {
+		if bm, ok := bms_by_id[id]; ok {
+			bms = append(bms, bm)
+		}
 	}
+	return bms, DB.LoadLinksTags(bms)
 }
 
-func getLinksTags(link_id int64) (result []*Tag) {
-	stmt, err := DB.Prepare(
-		`SELECT
-			tags.id,
-			tags.title,
-			tags.slug
-		FROM
-			rel_links_tags
-		LEFT JOIN
-			tags
-		ON
-			rel_links_tags.tag_id = tags.id
-		WHERE
-			rel_links_tags.link_id=?`)
-	checkErr(err)
-	rows, err := stmt.Query(link_id)
-	defer rows.Close()
-	checkErr(err)
-	for rows.Next() {
-		tag := new(Tag)
-		err := rows.Scan(&tag.Id, &tag.Title, &tag.Slug)
-		checkErr(err)
-		result = append(result, tag)
-	}
-	return result
+func getBookmark(id int64) (*BookmarkItem, error) {
+	return DB.GetBookmark(id)
+}
+
+// Cursor locates a bookmark in links ordered by (createdate, id), it is
+// used for keyset pagination
+type Cursor struct {
+	CreateDate string
+	Id         int64
 }
 
-func getBookmark(id int64) *BookmarkItem {
-	bookmark_item := new(BookmarkItem)
-	err := DB.QueryRow("SELECT id, title, url, createdate FROM links WHERE id=?", id).Scan(
-		&bookmark_item.Id,
-		&bookmark_item.Title,
-		&bookmark_item.Url,
-		&bookmark_item.CreateDate,
+func (c *Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(c.CreateDate + "|" + strconv.FormatInt(c.Id, 10)),
 	)
-	checkErr(err)
-	bookmark_item.Tags = getLinksTags(id)
-	return bookmark_item
-}
-
-func queryBookmark(page int, items_by_page int, tags string) []*BookmarkItem {
-	var rows *sql.Rows
-
-	if tags != "" {
-		stmt, err := DB.Prepare(
-			`SELECT
-				links.id,
-				links.title,
-				links.url,
-				links.createdate
-			FROM
-				links
-			LEFT JOIN
-				rel_links_tags
-			ON
-				rel_links_tags.link_id = links.id
-			LEFT JOIN
-				tags
-			ON
-				rel_links_tags.tag_id = tags.id
-			WHERE
-				tags.slug IN (?)
-			ORDER BY
-				links.createdate DESC
-			LIMIT ? OFFSET ?`)
-		checkErr(err)
-		rows, err = stmt.Query(tags, items_by_page, (page-1)*items_by_page)
-		checkErr(err)
-	} else {
-		stmt, err := DB.Prepare(
-			`SELECT
-				id,
-				title,
-				url,
-				createdate
-			FROM
-				links
-			ORDER BY
-				createdate DESC
-			LIMIT ? OFFSET ?`)
-		checkErr(err)
-		rows, err = stmt.Query(items_by_page, (page-1)*items_by_page)
-		checkErr(err)
+}
+
+func parseCursor(value string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
 	}
-	defer rows.Close()
+	i := strings.LastIndex(string(decoded), "|")
+	if i == -1 {
+		return nil, fmt.Errorf("%s cursor is invalid", value)
+	}
+	id, err := strconv.ParseInt(string(decoded[i+1:]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{string(decoded[:i]), id}, nil
+}
 
-	bms := make([]*BookmarkItem, 0)
-	for rows.Next() {
-		bm := new(BookmarkItem)
-		err := rows.Scan(&bm.Id, &bm.Title, &bm.Url, &bm.CreateDate)
-		checkErr(err)
+// queryBookmark returns items_by_page bookmarks, newest first, older than
+// after cursor or newer than before cursor (first page if both are nil).
+// prev and next are the cursors of the adjacent pages, nil if there is none.
+func queryBookmark(after *Cursor, before *Cursor, items_by_page int, tags string) (bms []*BookmarkItem, prev *Cursor, next *Cursor, err error) {
+	// One more item is fetched to know if there is a page after this one
+	bms, cursors, err := DB.QueryBookmarks(after, before, items_by_page+1, tags)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		bm.Tags = getLinksTags(bm.Id)
+	has_more := len(bms) > items_by_page
+	if has_more {
+		bms = bms[:items_by_page]
+		cursors = cursors[:items_by_page]
+	}
+	if before != nil {
+		for i, j := 0, len(bms)-1; i < j; i, j = i+1, j-1 {
+			bms[i], bms[j] = bms[j], bms[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+	}
 
-		bms = append(bms, bm)
+	if len(bms) > 0 {
+		if (before == nil && after != nil) || (before != nil && has_more) {
+			prev = cursors[0]
+		}
+		if (before == nil && has_more) || before != nil {
+			next = cursors[len(cursors)-1]
+		}
 	}
-	return bms
-}
 
-func searchBookmark(search string, page int, items_by_page int) (total int, bms []*BookmarkItem) {
-	tags := extractTags(search)
-	search = removeTags(search)
+	return bms, prev, next, DB.LoadLinksTags(bms)
+}
 
-	var tags_query_list []bleve.Query
-	tags_query_list = nil
+func getLinksYears() ([]int, error) {
+	return DB.LinksYears()
+}
 
-	if len(tags) > 0 {
-		tags_query_list = make([]bleve.Query, 0)
-		for _, tag := range tags {
-			q := bleve.NewQueryStringQuery("tags:" + tag)
-			tags_query_list = append(tags_query_list, q)
-		}
+func searchBookmark(search string, page int, items_by_page int) (total int, bms []*BookmarkItem, facets *SearchFacets, err error) {
+	start := time.Now()
+	total, ids, facets, err := SEARCH.Search(parseSearchQuery(search), page, items_by_page)
+	searchDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return 0, nil, nil, err
 	}
 
-	var query bleve.Query
-
-	if search != "" {
-		query_list := make([]bleve.Query, 2)
-		fuzzy_query := bleve.NewFuzzyQuery(search)
-		fuzzy_query.FuzzinessVal = 1
-		query_list[0] = fuzzy_query
-		query_list[1] = bleve.NewRegexpQuery("[a-zA-Z0-9_]*" + search + "[a-zA-Z0-9_]*")
-		query = bleve.NewBooleanQuery(tags_query_list, query_list, nil)
-	} else {
-		query = bleve.NewBooleanQuery(tags_query_list, nil, nil)
+	bms, err = getBookmarks(ids)
+	if err != nil {
+		return 0, nil, nil, err
 	}
-	searchRequest := bleve.NewSearchRequestOptions(query, items_by_page, (page-1)*items_by_page, false)
-	sr, err := INDEX.Search(searchRequest)
-	checkErr(err)
-
-	bms = make([]*BookmarkItem, 0)
-
-	if sr.Total > 0 {
-		if sr.Request.Size > 0 {
-			for _, hit := range sr.Hits {
-				id, err := strconv.ParseInt(hit.ID, 10, 64)
-				checkErr(err)
-				bms = append(bms, getBookmark(id))
-			}
-		}
+	return total, bms, facets, nil
+}
+
+// insertSavedSearch replaces existing saved search with the same slug
+func insertSavedSearch(name string, query string) (id int64, err error) {
+	if slug.Slug(name) == "" {
+		return 0, validationError("Saved search name must contain letters or digits")
 	}
+	return DB.InsertSavedSearch(name, query)
+}
+
+func deleteSavedSearch(search_slug string) error {
+	return DB.DeleteSavedSearch(search_slug)
+}
+
+func getSavedSearch(search_slug string) (*SavedSearch, error) {
+	return DB.GetSavedSearch(search_slug)
+}
+
+func querySavedSearches() ([]*SavedSearch, error) {
+	return DB.SavedSearches()
+}
+
+// getSetting returns a not found error if name setting isn't stored
+func getSetting(name string) (value string, err error) {
+	return DB.GetSetting(name)
+}
+
+func setSetting(name string, value string) error {
+	return DB.SetSetting(name, value)
+}
+
+func deleteSetting(name string) error {
+	return DB.DeleteSetting(name)
+}
+
+// advanceSetting stores counter in name setting if it is greater than the
+// stored one, it returns false otherwise
+func advanceSetting(name string, counter int64) (bool, error) {
+	return DB.AdvanceSetting(name, counter)
+}
+
+// replaceRecoveryCodes removes existing recovery codes and stores hashes
+func replaceRecoveryCodes(hashes []string) error {
+	return DB.ReplaceRecoveryCodes(hashes)
+}
+
+// recoveryCodes returns the hashes of recovery codes by id
+func recoveryCodes() (map[int64]string, error) {
+	return DB.RecoveryCodes()
+}
+
+// deleteRecoveryCode returns false if id recovery code was already deleted
+func deleteRecoveryCode(id int64) (bool, error) {
+	return DB.DeleteRecoveryCode(id)
+}
+
+func countRecoveryCodes() (count int, err error) {
+	return DB.CountRecoveryCodes()
+}
+
+func insertWebAuthnCredential(credential *WebAuthnCredential) error {
+	return DB.InsertWebAuthnCredential(credential)
+}
+
+// getWebAuthnCredential returns a not found error if there is no credential
+// with credential_id
+func getWebAuthnCredential(credential_id string) (*WebAuthnCredential, error) {
+	return DB.GetWebAuthnCredential(credential_id)
+}
+
+func queryWebAuthnCredentials() ([]*WebAuthnCredential, error) {
+	return DB.WebAuthnCredentials()
+}
+
+func updateWebAuthnSignCount(id int64, sign_count uint32) error {
+	return DB.UpdateWebAuthnSignCount(id, sign_count)
+}
 
-	return int(sr.Total), bms
+func deleteWebAuthnCredential(id int64) error {
+	return DB.DeleteWebAuthnCredential(id)
 }
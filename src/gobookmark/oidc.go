@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OidcConfig configures OpenID Connect login, authorization code flow with
+// PKCE against a single issuer
+type OidcConfig struct {
+	Issuer       string `toml:"issuer" yaml:"issuer" flag:"oidc-issuer" env:"GOBOOKMARK_OIDC_ISSUER"`
+	ClientId     string `toml:"client_id" yaml:"client_id" flag:"oidc-client-id" env:"GOBOOKMARK_OIDC_CLIENT_ID"`
+	ClientSecret string `toml:"client_secret" yaml:"client_secret" flag:"oidc-client-secret" env:"GOBOOKMARK_OIDC_CLIENT_SECRET" secret:"true"`
+	// RedirectUrl defaults to <request origin><base path>/login/oidc/callback/
+	RedirectUrl     string   `toml:"redirect_url" yaml:"redirect_url" flag:"oidc-redirect-url" env:"GOBOOKMARK_OIDC_REDIRECT_URL"`
+	AllowedSubjects []string `toml:"allowed_subjects" yaml:"allowed_subjects" flag:"oidc-allowed-subjects" env:"GOBOOKMARK_OIDC_ALLOWED_SUBJECTS"`
+	AllowedGroups   []string `toml:"allowed_groups" yaml:"allowed_groups" flag:"oidc-allowed-groups" env:"GOBOOKMARK_OIDC_ALLOWED_GROUPS"`
+	GroupsClaim     string   `toml:"groups_claim" yaml:"groups_claim" flag:"oidc-groups-claim" env:"GOBOOKMARK_OIDC_GROUPS_CLAIM"`
+}
+
+// oidcNow is the clock used to check ID token validity, tests replace it
+var oidcNow = time.Now
+
+// oidcClockSkew is the tolerance on ID token exp and iat claims
+const oidcClockSkew = 60 * time.Second
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcProvider struct {
+	config OidcConfig
+
+	lock                  sync.Mutex
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksUri               string
+	keys                  map[string]*rsa.PublicKey
+}
+
+// oidcIdentity is the identity extracted from a verified ID token
+type oidcIdentity struct {
+	Subject string
+	Name    string
+	Groups  []string
+}
+
+func newOidcProvider(config OidcConfig) (*oidcProvider, error) {
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+	if config.Issuer == "" || config.ClientId == "" {
+		return nil, errors.New("OIDC issuer and client id are required")
+	}
+	if len(config.AllowedSubjects) == 0 && len(config.AllowedGroups) == 0 {
+		return nil, errors.New("OIDC requires allowed subjects or allowed groups, otherwise any account of the issuer could log in")
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &oidcProvider{config: config}, nil
+}
+
+func (p *oidcProvider) getJson(url string, v interface{}) error {
+	resp, err := oidcHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the issuer configuration once
+func (p *oidcProvider) discover() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+
+	var configuration struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+	}
+	err := p.getJson(p.config.Issuer+"/.well-known/openid-configuration", &configuration)
+	if err != nil {
+		return err
+	}
+	if strings.TrimRight(configuration.Issuer, "/") != p.config.Issuer {
+		return fmt.Errorf("OIDC discovery issuer is %q instead of %q", configuration.Issuer, p.config.Issuer)
+	}
+	if configuration.AuthorizationEndpoint == "" || configuration.TokenEndpoint == "" || configuration.JwksUri == "" {
+		return errors.New("OIDC discovery document is incomplete")
+	}
+	p.authorizationEndpoint = configuration.AuthorizationEndpoint
+	p.tokenEndpoint = configuration.TokenEndpoint
+	p.jwksUri = configuration.JwksUri
+	return nil
+}
+
+// publicKey returns the RSA key kid, keys are fetched again when kid is
+// unknown so the issuer can rotate them
+func (p *oidcProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJson(p.jwksUri, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err_n := decodeBase64Url(jwk.N)
+		e, err_e := decodeBase64Url(jwk.E)
+		if err_n != nil || err_e != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("OIDC key %q not found", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) redirectUrl(r *http.Request) string {
+	if p.config.RedirectUrl != "" {
+		return p.config.RedirectUrl
+	}
+	return requestOrigin(r) + BasePath + "/login/oidc/callback/"
+}
+
+// authorizationUrl returns the issuer URL the browser is redirected to
+func (p *oidcProvider) authorizationUrl(r *http.Request, state string, nonce string, code_verifier string) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(code_verifier))
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientId},
+		"redirect_uri":          {p.redirectUrl(r)},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {encodeBase64Url(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authorizationEndpoint + separator + values.Encode(), nil
+}
+
+// exchange trades the authorization code for a verified identity
+func (p *oidcProvider) exchange(r *http.Request, code string, nonce string, code_verifier string) (*oidcIdentity, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	values := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectUrl(r)},
+		"code_verifier": {code_verifier},
+	}
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+	resp, err := oidcHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC token endpoint returned %s", resp.Status)
+	}
+
+	var token struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return p.verifyIdToken(token.IdToken, nonce)
+}
+
+// verifyIdToken checks RS256 signature and claims of id_token
+func (p *oidcProvider) verifyIdToken(id_token string, nonce string) (*oidcIdentity, error) {
+	parts := strings.Split(id_token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token isn't a JWT")
+	}
+	raw_header, err_header := decodeBase64Url(parts[0])
+	raw_claims, err_claims := decodeBase64Url(parts[1])
+	signature, err_signature := decodeBase64Url(parts[2])
+	if err_header != nil || err_claims != nil || err_signature != nil {
+		return nil, errors.New("ID token encoding is invalid")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(raw_header, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token algorithm %q isn't supported", header.Alg)
+	}
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, errors.New("ID token signature is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(raw_claims, &claims); err != nil {
+		return nil, err
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimRight(issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("ID token issuer is %q", claims["iss"])
+	}
+	if !stringsContain(claimStrings(claims["aud"]), p.config.ClientId) {
+		return nil, errors.New("ID token audience doesn't contain client id")
+	}
+	if nonce == "" || claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	now := oidcNow()
+	expiration, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(expiration), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token is expired")
+	}
+	if issued_at, ok := claims["iat"].(float64); ok && time.Unix(int64(issued_at), 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+
+	identity := &oidcIdentity{
+		Groups: claimStrings(claims[p.config.GroupsClaim]),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("ID token subject is missing")
+	}
+	for _, name := range []string{"preferred_username", "email", "name"} {
+		if value, ok := claims[name].(string); ok && value != "" {
+			identity.Name = value
+			break
+		}
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Subject
+	}
+	return identity, nil
+}
+
+// isAllowed returns true if identity subject or one of its groups is allowed
+func (p *oidcProvider) isAllowed(identity *oidcIdentity) bool {
+	if stringsContain(p.config.AllowedSubjects, identity.Subject) {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if stringsContain(p.config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings returns a string or array of strings claim as a slice
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func stringsContain(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// generateOidcToken returns a random value for state, nonce and PKCE verifier
+func generateOidcToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encodeBase64Url(b), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BasePath is the path prefix gobookmark is served under behind a reverse
+// proxy, for example /bookmarks, without trailing slash
+var BasePath string
+
+// remoteUser returns the user name set by the authentication proxy, or an
+// empty string
+func remoteUser(r *http.Request) string {
+	auth_header := settings().AuthHeader
+	if auth_header == "" {
+		return ""
+	}
+	if !isTrustedPeer(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(auth_header))
+}
+
+// isLoggedIn returns true if the authentication proxy or the session logged
+// in request user
+func isLoggedIn(r *http.Request) bool {
+	if user, _ := context.Get(r, "remote_user").(string); user != "" {
+		return true
+	}
+	return sessions.GetSession(r).Get("login") != nil
+}
+
+// proxyLogin replaces password login when the authentication proxy logs
+// users in
+func proxyLogin(w http.ResponseWriter, r *http.Request) {
+	if remoteUser(r) != "" {
+		redirect(w, r, "/", 303)
+		return
+	}
+	http.Error(w, "Login is handled by the authentication proxy", http.StatusForbidden)
+}
+
+// BasePathMiddleware removes BasePath from request path, so routes are the
+// same whether the proxy strips it or not
+func BasePathMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if BasePath != "" {
+		if r.URL.Path == BasePath {
+			http.Redirect(rw, r, BasePath+"/", 301)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, BasePath+"/") {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, BasePath)
+			r.URL.RawPath = ""
+		}
+	}
+	next(rw, r)
+}
+
+// redirect is http.Redirect for application paths, target is prefixed with
+// BasePath once made absolute
+func redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	u, err := url.Parse(target)
+	if err != nil || u.IsAbs() {
+		http.Redirect(w, r, target, code)
+		return
+	}
+	http.Redirect(w, r, BasePath+r.URL.ResolveReference(u).RequestURI(), code)
+}
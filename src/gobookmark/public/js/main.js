@@ -1,10 +1,33 @@
 $(document).ready(function() {
   console.log("fooobar");
   $('input[name="url"]').bind("propertychange change click keyup input paste", function() {
-    $.get("/fetch-title/?url=" + $('input[name="url"]').val(), function(data) {
+    var base_path = $('meta[name="base-path"]').attr('content') || '';
+    $.get(base_path + "/fetch-title/?url=" + encodeURIComponent($('input[name="url"]').val()), function(data) {
       if (data != '') {
         $('input[name="title"]').val(data);
       }
     });
   });
+
+  // Infinite scroll : load next page fragment when the bottom of the page is reached
+  var $links = $('ul.links[data-infinite-scroll]');
+  var loading = false;
+  if ($links.length) {
+    $(window).scroll(function() {
+      var $next = $('.cursor-pagination a.next-page').last();
+      if (loading || !$next.length) {
+        return;
+      }
+      if ($(window).scrollTop() + $(window).height() < $(document).height() - 200) {
+        return;
+      }
+      loading = true;
+      $.get($next.attr('href') + '&fragment=1', function(data) {
+        var $fragment = $('<div>').html(data);
+        $links.append($fragment.find('ul.links > li'));
+        $next.closest('.cursor-pagination').replaceWith($fragment.find('.cursor-pagination'));
+        loading = false;
+      });
+    });
+  }
 });
@@ -0,0 +1,90 @@
+// Passkey registration and login, binary values are exchanged with the
+// server as unpadded base64url strings
+(function() {
+  function toBase64Url(buffer) {
+    var bytes = new Uint8Array(buffer);
+    var binary = '';
+    for (var i = 0; i < bytes.length; i++) {
+      binary += String.fromCharCode(bytes[i]);
+    }
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+
+  function fromBase64Url(value) {
+    var binary = atob(value.replace(/-/g, '+').replace(/_/g, '/'));
+    var bytes = new Uint8Array(binary.length);
+    for (var i = 0; i < binary.length; i++) {
+      bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes.buffer;
+  }
+
+  // jQuery 2 deferreds don't chain native promises, wrap them
+  function post(url, data) {
+    return Promise.resolve($.ajax({
+      url: ($('meta[name="base-path"]').attr('content') || '') + url,
+      method: 'POST',
+      contentType: 'application/json',
+      dataType: 'json',
+      headers: {'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content')},
+      data: JSON.stringify(data || {})
+    }));
+  }
+
+  function showError(error) {
+    var message = error && error.responseJSON ? error.responseJSON.error : String(error);
+    $('.webauthn-error').text(message).show();
+  }
+
+  function credentialDescriptors(descriptors) {
+    return $.map(descriptors || [], function(descriptor) {
+      return {type: descriptor.type, id: fromBase64Url(descriptor.id)};
+    });
+  }
+
+  function register(name) {
+    post('/webauthn/register/begin/').then(function(options) {
+      options.challenge = fromBase64Url(options.challenge);
+      options.user.id = fromBase64Url(options.user.id);
+      options.excludeCredentials = credentialDescriptors(options.excludeCredentials);
+      return navigator.credentials.create({publicKey: options});
+    }).then(function(credential) {
+      return post('/webauthn/register/finish/', {
+        id: toBase64Url(credential.rawId),
+        name: name,
+        clientDataJSON: toBase64Url(credential.response.clientDataJSON),
+        attestationObject: toBase64Url(credential.response.attestationObject)
+      });
+    }).then(function(result) {
+      window.location = result.redirect;
+    }, showError);
+  }
+
+  function login() {
+    post('/login/webauthn/begin/').then(function(options) {
+      options.challenge = fromBase64Url(options.challenge);
+      options.allowCredentials = credentialDescriptors(options.allowCredentials);
+      return navigator.credentials.get({publicKey: options});
+    }).then(function(credential) {
+      return post('/login/webauthn/finish/', {
+        id: toBase64Url(credential.rawId),
+        clientDataJSON: toBase64Url(credential.response.clientDataJSON),
+        authenticatorData: toBase64Url(credential.response.authenticatorData),
+        signature: toBase64Url(credential.response.signature)
+      });
+    }).then(function(result) {
+      window.location = result.redirect;
+    }, showError);
+  }
+
+  $(document).ready(function() {
+    if (!window.PublicKeyCredential) {
+      return;
+    }
+    $('button.webauthn-login').show().click(login);
+    $('form.webauthn-register').submit(function(event) {
+      event.preventDefault();
+      register($(this).find('input[name="name"]').val());
+    });
+  });
+})();
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnixSocket is true when gobookmark listens on a unix socket, its peers
+// are trusted as proxies
+var UnixSocket bool
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter throttles failed login attempts by IP and globally: after
+// freeAttempts failures, each new failure locks logins for an exponentially
+// growing delay, up to maxLockout
+type loginLimiter struct {
+	mutex sync.Mutex
+	now   func() time.Time
+
+	freeAttempts       int
+	globalFreeAttempts int
+	baseDelay          time.Duration
+	maxLockout         time.Duration
+	globalMaxLockout   time.Duration
+	// failures are forgotten after resetAfter without new failure
+	resetAfter time.Duration
+
+	failures map[string]*loginFailures
+	global   *loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		now:                time.Now,
+		freeAttempts:       3,
+		globalFreeAttempts: 50,
+		baseDelay:          time.Second,
+		maxLockout:         15 * time.Minute,
+		globalMaxLockout:   time.Minute,
+		resetAfter:         time.Hour,
+		failures:           make(map[string]*loginFailures),
+		global:             new(loginFailures),
+	}
+}
+
+var LoginLimiter = newLoginLimiter()
+
+func (l *loginLimiter) backoff(count int, free_attempts int, max time.Duration) time.Duration {
+	if count < free_attempts {
+		return 0
+	}
+	delay := float64(l.baseDelay) * math.Pow(2, float64(count-free_attempts))
+	if delay > float64(max) {
+		return max
+	}
+	return time.Duration(delay)
+}
+
+func (l *loginLimiter) expire(f *loginFailures, now time.Time) {
+	if f.count > 0 && now.Sub(f.last) > l.resetAfter {
+		*f = loginFailures{}
+	}
+}
+
+// wait returns how long ip must wait before its next login attempt
+func (l *loginLimiter) wait(ip string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.waitLocked(ip, l.now())
+}
+
+func (l *loginLimiter) waitLocked(ip string, now time.Time) time.Duration {
+	result := time.Duration(0)
+	l.expire(l.global, now)
+	if l.global.lockedUntil.After(now) {
+		result = l.global.lockedUntil.Sub(now)
+	}
+	if f, ok := l.failures[ip]; ok {
+		l.expire(f, now)
+		if f.lockedUntil.After(now) && f.lockedUntil.Sub(now) > result {
+			result = f.lockedUntil.Sub(now)
+		}
+	}
+	return result
+}
+
+// begin reserves a login attempt of ip, it returns how long ip must wait
+// otherwise. The attempt is counted as a failure until success is called, so
+// concurrent attempts can't all pass before the first one fails.
+func (l *loginLimiter) begin(ip string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if wait := l.waitLocked(ip, now); wait > 0 {
+		return wait
+	}
+	l.failLocked(ip, now)
+	return 0
+}
+
+func (l *loginLimiter) fail(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.failLocked(ip, l.now())
+}
+
+func (l *loginLimiter) failLocked(ip string, now time.Time) {
+	f, ok := l.failures[ip]
+	if !ok {
+		f = new(loginFailures)
+		l.failures[ip] = f
+	}
+	l.expire(f, now)
+	f.count++
+	f.last = now
+	f.lockedUntil = now.Add(l.backoff(f.count, l.freeAttempts, l.maxLockout))
+
+	l.expire(l.global, now)
+	l.global.count++
+	l.global.last = now
+	l.global.lockedUntil = now.Add(l.backoff(l.global.count, l.globalFreeAttempts, l.globalMaxLockout))
+
+	// Forget expired IPs so the map doesn't grow forever
+	for key, failures := range l.failures {
+		if now.Sub(failures.last) > l.resetAfter {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// success forgets the failures of ip and the global failure counted by
+// begin
+func (l *loginLimiter) success(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.failures, ip)
+	if l.global.count > 0 {
+		l.global.count--
+		l.global.lockedUntil = l.global.last.Add(l.backoff(l.global.count, l.globalFreeAttempts, l.globalMaxLockout))
+	}
+}
+
+func parseTrustedProxies(value string) (result []*net.IPNet, err error) {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			if strings.Contains(field, ":") {
+				field += "/128"
+			} else {
+				field += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range settings().TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedPeer returns true if the request connection comes from a trusted
+// proxy, or from the unix socket, which only local processes can reach
+func isTrustedPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if UnixSocket && (host == "" || host == "@") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isTrustedProxy(ip)
+}
+
+// clientIP returns the request remote address, X-Forwarded-For is followed
+// only through TrustedProxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedPeer(r) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwarded_ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwarded_ip == nil {
+			break
+		}
+		host = forwarded_ip.String()
+		if !isTrustedProxy(forwarded_ip) {
+			break
+		}
+	}
+	return host
+}
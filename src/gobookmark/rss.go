@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"time"
+)
+
+type rssItem struct {
+	Title      string   `xml:"title"`
+	Link       string   `xml:"link"`
+	Guid       string   `xml:"guid"`
+	PubDate    string   `xml:"pubDate"`
+	Categories []string `xml:"category"`
+}
+
+type rssChannel struct {
+	Title       string     `xml:"title"`
+	Link        string     `xml:"link"`
+	Description string     `xml:"description"`
+	Items       []*rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name    `xml:"rss"`
+	Version string      `xml:"version,attr"`
+	Channel *rssChannel `xml:"channel"`
+}
+
+// writeRss writes bms as a RSS 2.0 feed
+func writeRss(w io.Writer, title string, link string, bms []*BookmarkItem) error {
+	channel := &rssChannel{
+		Title:       title,
+		Link:        link,
+		Description: title,
+		Items:       make([]*rssItem, 0, len(bms)),
+	}
+	for _, bm := range bms {
+		item := &rssItem{
+			Title:   bm.Title,
+			Link:    bm.Url,
+			Guid:    link + "#" + strconv.FormatInt(bm.Id, 10),
+			PubDate: bm.CreateDate.Format(time.RFC1123Z),
+		}
+		for _, tag := range bm.Tags {
+			item.Categories = append(item.Categories, tag.Title)
+		}
+		channel.Items = append(channel.Items, item)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(&rssFeed{Version: "2.0", Channel: channel})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/extemporalgenome/slug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Search engines
+const (
+	searchEngineBleve = "bleve"
+	searchEngineFts5  = "fts5"
+)
+
+var searchEngines = []string{searchEngineBleve, searchEngineFts5}
+
+func isSearchEngine(name string) bool {
+	for _, engine := range searchEngines {
+		if engine == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SEARCH is the search engine behind searchBookmark
+var SEARCH SearchEngine = bleveSearch{}
+
+// SearchEngine finds bookmarks. Index and Unindex are called when links are
+// saved or deleted, engines kept in sync by the database ignore them.
+type SearchEngine interface {
+	Index(item *BookmarkItem) error
+	Unindex(id int64) error
+	// Search returns the ids of page bookmarks matching query, best first,
+	// with the total of matching bookmarks and their facets
+	Search(query *SearchQuery, page int, items_by_page int) (total int, ids []int64, facets *SearchFacets, err error)
+	// Count returns the number of searchable bookmarks
+	Count() (uint64, error)
+	// Rebuild reindexes all bookmarks, searches are served meanwhile
+	Rebuild(logger *Logger) error
+}
+
+// SearchQuery is a parsed search. Tags, domain and dates filter bookmarks,
+// text ranks them, it filters them too when there is no other filter.
+type SearchQuery struct {
+	Text   string
+	Tags   []string
+	Domain string
+	// Start is inclusive and End exclusive, both are optional
+	Start *time.Time
+	End   *time.Time
+}
+
+// parseSearchQuery parses "[tag]" and "name:value" operators of search
+func parseSearchQuery(search string) *SearchQuery {
+	operators := extractOperators(search)
+	query := &SearchQuery{
+		Text:   removeOperators(removeTags(search)),
+		Domain: strings.ToLower(operators["domain"]),
+	}
+	for _, tag := range extractTags(search) {
+		query.Tags = append(query.Tags, slug.Slug(tag))
+	}
+
+	if year, err := strconv.Atoi(operators["year"]); err == nil {
+		year_start := time.Date(year, 1, 1, 0, 0, 0, 0, time.Local)
+		year_end := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.Local)
+		query.Start = &year_start
+		query.End = &year_end
+	}
+	if after, err := parseSearchDate(operators["after"]); err == nil {
+		query.Start = &after
+	}
+	if before, err := parseSearchDate(operators["before"]); err == nil {
+		query.End = &before
+	}
+	return query
+}
+
+// hasFilters returns true if query has tags, domain or dates
+func (q *SearchQuery) hasFilters() bool {
+	return len(q.Tags) > 0 || q.Domain != "" || q.Start != nil || q.End != nil
+}
+
+// openSearchEngine opens engine, it's called once the database is opened.
+// Bleve index is opened from index_filename.
+func openSearchEngine(engine string, index_filename string) (SearchEngine, error) {
+	switch engine {
+	case searchEngineBleve:
+		if err := openSwappableBleve(index_filename); err != nil {
+			return nil, err
+		}
+		// links_fts of a previous fts5 run would be updated on each write
+		dropped, err := dropFts5Search()
+		if err != nil {
+			LOG.Warn("SQLite FTS5 table removal failed", "error", err)
+		} else if dropped {
+			LOG.Info("SQLite FTS5 table dropped, the bleve search engine is used")
+		}
+		return bleveSearch{}, nil
+	case searchEngineFts5:
+		return openFts5Search()
+	}
+	return nil, fmt.Errorf("search engine %q isn't supported (%s)", engine, strings.Join(searchEngines, ", "))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"github.com/blevesearch/bleve"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// linksYears caches the years of links, which bound the years facet ranges.
+// It's cleared when the index is opened or written.
+var linksYears struct {
+	sync.Mutex
+	years  []int
+	loaded bool
+}
+
+func cachedLinksYears() ([]int, error) {
+	linksYears.Lock()
+	defer linksYears.Unlock()
+	if !linksYears.loaded {
+		years, err := getLinksYears()
+		if err != nil {
+			return nil, err
+		}
+		linksYears.years = years
+		linksYears.loaded = true
+	}
+	return linksYears.years, nil
+}
+
+func clearLinksYears() {
+	linksYears.Lock()
+	linksYears.loaded = false
+	linksYears.years = nil
+	linksYears.Unlock()
+}
+
+// bleveSearch searches INDEX, which must be updated when links change
+type bleveSearch struct{}
+
+func (bleveSearch) Index(item *BookmarkItem) error {
+	defer clearLinksYears()
+	id := strconv.FormatInt(item.Id, 10)
+	x := newBookmarkDocument(item)
+
+	// Index being rebuilt must receive updates too, else they are lost when
+	// it is swapped in
+	err := updatePendingIndex(func(index bleve.Index) error {
+		return index.Index(id, x)
+	})
+	if err != nil {
+		return err
+	}
+	return INDEX.Index(id, x)
+}
+
+func (bleveSearch) Unindex(id int64) error {
+	defer clearLinksYears()
+	if err := unindexPending(id); err != nil {
+		return err
+	}
+	return INDEX.Delete(strconv.FormatInt(id, 10))
+}
+
+// searchDateRangeQuery builds createdate range query from query dates
+func searchDateRangeQuery(query *SearchQuery) bleve.Query {
+	var start, end *string
+
+	if query.Start != nil {
+		start_str := query.Start.Format(time.RFC3339)
+		start = &start_str
+	}
+	if query.End != nil {
+		end_str := query.End.Format(time.RFC3339)
+		end = &end_str
+	}
+
+	if start == nil && end == nil {
+		return nil
+	}
+	return bleve.NewDateRangeQuery(start, end).SetField("createdate")
+}
+
+// languagesTitleQueries matches search against titles of each language
+// analyzed with the same analyzer, so that "chevaux" finds "cheval"
+func languagesTitleQueries(search string) []bleve.Query {
+	queries := make([]bleve.Query, 0, len(supportedLanguages()))
+	for _, lang := range supportedLanguages() {
+		title_query := bleve.NewMatchQuery(search)
+		title_query.Analyzer = lang
+		queries = append(queries, bleve.NewConjunctionQuery([]bleve.Query{
+			title_query.SetField("title"),
+			bleve.NewTermQuery(lang).SetField("lang"),
+		}))
+	}
+	return queries
+}
+
+func (bleveSearch) Search(search_query *SearchQuery, page int, items_by_page int) (total int, ids []int64, facets *SearchFacets, err error) {
+	var must_query_list []bleve.Query
+	must_query_list = nil
+
+	if search_query.hasFilters() {
+		must_query_list = make([]bleve.Query, 0)
+		for _, tag := range search_query.Tags {
+			q := bleve.NewTermQuery(tag).SetField("tags")
+			must_query_list = append(must_query_list, q)
+		}
+		if search_query.Domain != "" {
+			q := bleve.NewTermQuery(search_query.Domain).SetField("domain")
+			must_query_list = append(must_query_list, q)
+		}
+		if q := searchDateRangeQuery(search_query); q != nil {
+			must_query_list = append(must_query_list, q)
+		}
+	}
+
+	var query bleve.Query
+
+	if search := search_query.Text; search != "" {
+		query_list := make([]bleve.Query, 2)
+		fuzzy_query := bleve.NewFuzzyQuery(search)
+		fuzzy_query.FuzzinessVal = 1
+		query_list[0] = fuzzy_query
+		query_list[1] = bleve.NewRegexpQuery("[a-zA-Z0-9_]*" + search + "[a-zA-Z0-9_]*")
+		query_list = append(query_list, languagesTitleQueries(search)...)
+		query = bleve.NewBooleanQuery(must_query_list, query_list, nil)
+	} else {
+		query = bleve.NewBooleanQuery(must_query_list, nil, nil)
+	}
+	searchRequest := bleve.NewSearchRequestOptions(query, items_by_page, (page-1)*items_by_page, false)
+	searchRequest.AddFacet("tags", bleve.NewFacetRequest("tags", 10))
+	searchRequest.AddFacet("domain", bleve.NewFacetRequest("domain", 10))
+	years, err := cachedLinksYears()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(years) > 0 {
+		years_facet := bleve.NewFacetRequest("createdate", len(years))
+		for _, year := range years {
+			years_facet.AddDateTimeRange(
+				strconv.Itoa(year),
+				time.Date(year, 1, 1, 0, 0, 0, 0, time.Local),
+				time.Date(year+1, 1, 1, 0, 0, 0, 0, time.Local),
+			)
+		}
+		searchRequest.AddFacet("years", years_facet)
+	}
+	sr, err := INDEX.Search(searchRequest)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	ids = make([]int64, 0, len(sr.Hits))
+	for _, hit := range sr.Hits {
+		id, err := strconv.ParseInt(hit.ID, 10, 64)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	facets = new(SearchFacets)
+	if f, ok := sr.Facets["tags"]; ok {
+		for _, term := range f.Terms {
+			facets.Tags = append(facets.Tags, &Facet{term.Term, term.Count})
+		}
+	}
+	if f, ok := sr.Facets["domain"]; ok {
+		for _, term := range f.Terms {
+			facets.Domains = append(facets.Domains, &Facet{term.Term, term.Count})
+		}
+	}
+	if f, ok := sr.Facets["years"]; ok {
+		for _, date_range := range f.DateRanges {
+			if date_range.Count > 0 {
+				facets.Years = append(facets.Years, &Facet{date_range.Name, date_range.Count})
+			}
+		}
+	}
+
+	return int(sr.Total), ids, facets, nil
+}
+
+func (bleveSearch) Count() (uint64, error) {
+	if INDEX == nil {
+		return 0, errors.New("index isn't opened")
+	}
+	request := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 0, 0, false)
+	result, err := INDEX.Search(request)
+	if err != nil {
+		return 0, err
+	}
+	return result.Total, nil
+}
+
+func (bleveSearch) Rebuild(logger *Logger) error {
+	return rebuildIndex(logger)
+}
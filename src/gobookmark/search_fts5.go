@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// linksTagsSql returns space separated tag slugs of link_id link
+func linksTagsSql(link_id string) string {
+	return `COALESCE((
+		SELECT
+			group_concat(tags.slug, ' ')
+		FROM
+			rel_links_tags
+		JOIN
+			tags
+		ON
+			rel_links_tags.tag_id = tags.id
+		WHERE
+			rel_links_tags.link_id = ` + link_id + `
+	), '')`
+}
+
+// fts5Schema creates links_fts table and the triggers keeping it in sync with
+// links and their tags, its rowid is the link id. It's only created when the
+// fts5 engine is selected, gobookmark runs without FTS5 otherwise.
+var fts5Schema = []string{
+	`CREATE VIRTUAL TABLE links_fts USING fts5(title, url, tags)`,
+	`CREATE TRIGGER links_fts_insert AFTER INSERT ON links BEGIN
+		INSERT INTO links_fts (rowid, title, url, tags) VALUES (new.id, new.title, new.url, '');
+	END`,
+	`CREATE TRIGGER links_fts_update AFTER UPDATE ON links BEGIN
+		UPDATE links_fts SET title = new.title, url = new.url WHERE rowid = new.id;
+	END`,
+	`CREATE TRIGGER links_fts_delete AFTER DELETE ON links BEGIN
+		DELETE FROM links_fts WHERE rowid = old.id;
+	END`,
+	`CREATE TRIGGER links_fts_tags_insert AFTER INSERT ON rel_links_tags BEGIN
+		UPDATE links_fts SET tags = ` + linksTagsSql("new.link_id") + ` WHERE rowid = new.link_id;
+	END`,
+	`CREATE TRIGGER links_fts_tags_delete AFTER DELETE ON rel_links_tags BEGIN
+		UPDATE links_fts SET tags = ` + linksTagsSql("old.link_id") + ` WHERE rowid = old.link_id;
+	END`,
+}
+
+var fts5Triggers = []string{
+	"links_fts_insert",
+	"links_fts_update",
+	"links_fts_delete",
+	"links_fts_tags_insert",
+	"links_fts_tags_delete",
+}
+
+// fts5Search searches links_fts table of the SQLite database, triggers keep
+// it in sync so Index and Unindex do nothing
+type fts5Search struct {
+	db *sql.DB
+}
+
+func sqliteDB() (*sql.DB, bool) {
+	storage, ok := DB.(*sqliteStorage)
+	if !ok {
+		return nil, false
+	}
+	return storage.db, true
+}
+
+func fts5TableExists(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='links_fts'").Scan(&count)
+	return count > 0, err
+}
+
+// openFts5Search creates links_fts table and its triggers the first time,
+// then fills it
+func openFts5Search() (*fts5Search, error) {
+	db, ok := sqliteDB()
+	if !ok {
+		return nil, errors.New("fts5 search engine requires a SQLite database")
+	}
+	search := &fts5Search{db}
+	exists, err := fts5TableExists(db)
+	if err != nil || exists {
+		return search, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range fts5Schema {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			if strings.Contains(err.Error(), "no such module") {
+				return nil, errors.New("SQLite FTS5 isn't available, build gobookmark with -tags fts5")
+			}
+			return nil, err
+		}
+	}
+	if err := fillFts5Table(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	LOG.Info("SQLite FTS5 table created")
+	return search, tx.Commit()
+}
+
+// dropFts5Search removes links_fts table and its triggers, so links writes
+// don't update it while another engine is used. dropped is false when the
+// table doesn't exist.
+func dropFts5Search() (dropped bool, err error) {
+	db, ok := sqliteDB()
+	if !ok {
+		return false, nil
+	}
+	if exists, err := fts5TableExists(db); err != nil || !exists {
+		return false, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	for _, trigger := range fts5Triggers {
+		if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE links_fts"); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func fillFts5Table(tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM links_fts"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO links_fts (rowid, title, url, tags)
+		SELECT
+			links.id,
+			links.title,
+			links.url,
+			` + linksTagsSql("links.id") + `
+		FROM
+			links`)
+	return err
+}
+
+func (*fts5Search) Index(item *BookmarkItem) error {
+	return nil
+}
+
+func (*fts5Search) Unindex(id int64) error {
+	return nil
+}
+
+// fts5MatchQuery matches documents containing words starting with each
+// word of text
+func fts5MatchQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.Replace(word, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// urlDomainSql returns the SQL expression of urlDomain for url column, the
+// lower case host and port of url without user info nor "www." prefix
+func urlDomainSql(url string) string {
+	rest := "substr(" + url + ", instr(" + url + ", '://') + 3)"
+	authority := "lower(substr(" + rest + ", 1, min(" +
+		"instr(" + rest + " || '/', '/'), " +
+		"instr(" + rest + " || '?', '?'), " +
+		"instr(" + rest + " || '#', '#')) - 1))"
+	host := "substr(" + authority + ", instr(" + authority + ", '@') + 1)"
+	return "substr(" + host + ", CASE WHEN " + host + " LIKE 'www.%' THEN 5 ELSE 1 END)"
+}
+
+// sqliteDateFormat is the format of links createdate, in local time
+const sqliteDateFormat = "2006-01-02 15:04:05"
+
+// fts5Filters returns the FROM and WHERE clauses selecting links matching
+// query, with their arguments. When ranked is true, links matching query
+// text are joined to their matches.rank, the text filters links when query
+// has no other filter.
+func fts5Filters(query *SearchQuery) (from string, ranked bool, args []interface{}) {
+	from = "FROM links"
+	args = make([]interface{}, 0, len(query.Tags)+4)
+	if match := fts5MatchQuery(query.Text); match != "" {
+		ranked = true
+		join := "JOIN"
+		if query.hasFilters() {
+			join = "LEFT JOIN"
+		}
+		from += " " + join + ` (
+				SELECT
+					rowid AS id,
+					bm25(links_fts) AS rank
+				FROM
+					links_fts
+				WHERE
+					links_fts MATCH ?
+			) AS matches
+			ON
+				matches.id = links.id`
+		args = append(args, match)
+	}
+
+	where := make([]string, 0, len(query.Tags)+3)
+	for _, tag := range query.Tags {
+		where = append(where,
+			`links.id IN (
+				SELECT
+					rel_links_tags.link_id
+				FROM
+					rel_links_tags
+				JOIN
+					tags
+				ON
+					rel_links_tags.tag_id = tags.id
+				WHERE
+					tags.slug = ?
+			)`)
+		args = append(args, tag)
+	}
+	if query.Domain != "" {
+		where = append(where, urlDomainSql("links.url")+" = ?")
+		args = append(args, query.Domain)
+	}
+	if query.Start != nil {
+		where = append(where, "links.createdate >= ?")
+		args = append(args, query.Start.Local().Format(sqliteDateFormat))
+	}
+	if query.End != nil {
+		where = append(where, "links.createdate < ?")
+		args = append(args, query.End.Local().Format(sqliteDateFormat))
+	}
+	if len(where) > 0 {
+		from += " WHERE " + strings.Join(where, " AND ")
+	}
+	return from, ranked, args
+}
+
+// scanFacets reads (term, count) rows and closes them
+func scanFacets(rows *sql.Rows) ([]*Facet, error) {
+	defer rows.Close()
+
+	facets := make([]*Facet, 0)
+	for rows.Next() {
+		facet := new(Facet)
+		if err := rows.Scan(&facet.Term, &facet.Count); err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+	return facets, rows.Err()
+}
+
+// searchFacets counts the 10 most frequent tags and domains and all the
+// years of links selected by from, as Bleve does
+func (s *fts5Search) searchFacets(from string, args []interface{}) (*SearchFacets, error) {
+	facets := new(SearchFacets)
+	rows, err := s.db.Query(
+		`SELECT
+			tags.slug,
+			COUNT(*) AS count
+		FROM
+			rel_links_tags
+		JOIN
+			tags
+		ON
+			rel_links_tags.tag_id = tags.id
+		WHERE
+			rel_links_tags.link_id IN (SELECT links.id `+from+`)
+		GROUP BY
+			tags.slug
+		ORDER BY
+			count DESC, tags.slug
+		LIMIT 10`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if facets.Tags, err = scanFacets(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(
+		`SELECT
+			domain,
+			COUNT(*) AS count
+		FROM
+			(SELECT `+urlDomainSql("links.url")+` AS domain `+from+`)
+		WHERE
+			domain != ''
+		GROUP BY
+			domain
+		ORDER BY
+			count DESC, domain
+		LIMIT 10`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if facets.Domains, err = scanFacets(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(
+		`SELECT
+			CAST(substr(links.createdate, 1, 4) AS INTEGER) AS year,
+			COUNT(*)
+		`+from+`
+		GROUP BY
+			year
+		ORDER BY
+			year DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if facets.Years, err = scanFacets(rows); err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
+
+// Search returns links matching query text first, by rank, then the other
+// links newest first
+func (s *fts5Search) Search(query *SearchQuery, page int, items_by_page int) (total int, ids []int64, facets *SearchFacets, err error) {
+	if items_by_page < 1 {
+		return 0, nil, nil, validationError("items_by_page must be positive")
+	}
+	offset := (page - 1) * items_by_page
+	if offset < 0 {
+		offset = 0
+	}
+
+	from, ranked, args := fts5Filters(query)
+	order := "links.createdate DESC, links.id DESC"
+	if ranked {
+		order = "matches.rank IS NULL, matches.rank, " + order
+	}
+	rows, err := s.db.Query(
+		"SELECT links.id "+from+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		append(args, items_by_page, offset)...,
+	)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer rows.Close()
+	ids = make([]int64, 0, items_by_page)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, nil, nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	if err := s.db.QueryRow("SELECT COUNT(*) "+from, args...).Scan(&total); err != nil {
+		return 0, nil, nil, err
+	}
+	facets, err = s.searchFacets(from, args)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return total, ids, facets, nil
+}
+
+func (s *fts5Search) Count() (count uint64, err error) {
+	err = s.db.QueryRow("SELECT COUNT(*) FROM links_fts").Scan(&count)
+	return count, err
+}
+
+// Rebuild refills links_fts in a transaction, searches see the previous
+// content until it commits
+func (s *fts5Search) Rebuild(logger *Logger) error {
+	logger.Info("rebuild SQLite FTS5 table")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fillFts5Table(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errStopping = errors.New("gobookmark is stopping")
+
+// errWorkersRunning is returned when background workers, which may be
+// writing the index, didn't stop before the shutdown deadline
+var errWorkersRunning = errors.New("background workers didn't stop in time")
+
+var (
+	backgroundWorkers sync.WaitGroup
+	stoppingLock      sync.Mutex
+	stopping          = make(chan struct{})
+)
+
+// goBackground runs fn in a goroutine awaited by stopBackgroundWorkers,
+// fn logs with logger, which carries the request id of web triggered workers
+func goBackground(logger *Logger, name string, fn func(logger *Logger) error) {
+	logger = logger.With("worker", name)
+	backgroundWorkers.Add(1)
+	go func() {
+		defer backgroundWorkers.Done()
+		err := fn(logger)
+		backgroundWorkerRuns.WithLabelValues(name, resultLabel(err)).Inc()
+		if err != nil {
+			logger.Error("background worker failed", "error", err)
+		}
+	}()
+}
+
+// isStopping returns true once stopBackgroundWorkers is called, long
+// running workers check it to stop early
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopBackgroundWorkers asks workers to stop and waits for them at most
+// timeout
+func stopBackgroundWorkers(timeout time.Duration) error {
+	stoppingLock.Lock()
+	if !isStopping() {
+		close(stopping)
+	}
+	stoppingLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		backgroundWorkers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errWorkersRunning
+	}
+}
+
+// gracefulServer is a http.Server which drains in-flight requests on stop
+type gracefulServer struct {
+	*http.Server
+
+	lock     sync.Mutex
+	active   int
+	stopped  bool
+	drained  chan struct{}
+	listener net.Listener
+}
+
+func newGracefulServer(addr string, handler http.Handler, read_timeout time.Duration, write_timeout time.Duration) *gracefulServer {
+	s := &gracefulServer{drained: make(chan struct{})}
+	s.Server = &http.Server{
+		Addr:           addr,
+		Handler:        s.track(handler),
+		ReadTimeout:    read_timeout,
+		WriteTimeout:   write_timeout,
+		MaxHeaderBytes: 1 << 20,
+	}
+	return s
+}
+
+// track counts in-flight requests, requests received after stop on kept
+// alive connections are refused
+func (s *gracefulServer) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		if s.stopped {
+			s.lock.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Server is stopping", http.StatusServiceUnavailable)
+			return
+		}
+		s.active++
+		s.lock.Unlock()
+
+		defer func() {
+			s.lock.Lock()
+			s.active--
+			if s.stopped && s.active == 0 {
+				close(s.drained)
+			}
+			s.lock.Unlock()
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Serve accepts connections on listener until stop is called
+func (s *gracefulServer) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	err := s.Server.Serve(listener)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return nil
+	}
+	return err
+}
+
+// stop closes listener and waits at most timeout for in-flight requests
+func (s *gracefulServer) stop(timeout time.Duration) error {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return nil
+	}
+	s.stopped = true
+	if s.active == 0 {
+		close(s.drained)
+	}
+	listener := s.listener
+	s.lock.Unlock()
+
+	s.SetKeepAlivesEnabled(false)
+	if listener != nil {
+		listener.Close()
+	}
+
+	select {
+	case <-s.drained:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("in-flight requests didn't complete in time")
+	}
+}
+
+// listenedServer is a server and the listener it serves
+type listenedServer struct {
+	server   *gracefulServer
+	listener net.Listener
+}
+
+// serve runs servers until SIGINT or SIGTERM, then stops them and
+// background workers within shutdown_timeout. reload is called on SIGHUP.
+// workers_stopped is false when background workers are still running, the
+// index mustn't be closed then.
+func serve(servers []listenedServer, shutdown_timeout time.Duration, reload func()) (workers_stopped bool, err error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s listenedServer) {
+			errs <- s.server.Serve(s.listener)
+		}(s)
+	}
+
+	stop := func() (bool, error) {
+		deadline := time.Now().Add(shutdown_timeout)
+		var err error
+		for _, s := range servers {
+			if err_server := s.server.stop(deadline.Sub(time.Now())); err == nil {
+				err = err_server
+			}
+		}
+		return stopBackgroundWorkers(deadline.Sub(time.Now())) == nil, err
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			workers_stopped, _ := stop()
+			return workers_stopped, err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			LOG.Info("draining in-flight requests", "signal", sig)
+			return stop()
+		}
+	}
+}
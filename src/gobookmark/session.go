@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/codegangsta/negroni"
+	"github.com/goincremental/negroni-sessions"
+	"github.com/goincremental/negroni-sessions/cookiestore"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sessionKeysKept is the number of key pairs kept by rotateSessionKeys,
+// sessions signed with an older pair are invalidated
+const sessionKeysKept = 2
+
+type SessionSettings struct {
+	// Name is the session cookie name
+	Name string
+	// Keys are securecookie hash and block keys pairs, newest first
+	Keys     [][]byte
+	Secure   bool
+	MaxAge   int
+	SameSite string
+}
+
+var Session = SessionSettings{
+	Name:     "my_session",
+	MaxAge:   86400 * 30,
+	SameSite: "lax",
+}
+
+func generateSessionKeys() (hash_key []byte, block_key []byte, err error) {
+	hash_key = make([]byte, 64)
+	block_key = make([]byte, 32)
+	if _, err = rand.Read(hash_key); err != nil {
+		return nil, nil, err
+	}
+	if _, err = rand.Read(block_key); err != nil {
+		return nil, nil, err
+	}
+	return hash_key, block_key, nil
+}
+
+// parseSessionKeys parses "<hash key> <block key>" hexadecimal pairs
+// separated by new lines or commas
+func parseSessionKeys(value string) (keys [][]byte, err error) {
+	lines := strings.FieldsFunc(value, func(c rune) bool {
+		return c == '\n' || c == ','
+	})
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("session keys must be \"<hash key> <block key>\" pairs")
+		}
+		for _, field := range fields {
+			key, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session keys found")
+	}
+	return keys, nil
+}
+
+func formatSessionKeys(keys [][]byte) string {
+	lines := make([]string, 0, len(keys)/2)
+	for i := 0; i+1 < len(keys); i += 2 {
+		lines = append(lines, hex.EncodeToString(keys[i])+" "+hex.EncodeToString(keys[i+1]))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// loadSessionKeys reads session keys from filename, it is created with new
+// keys on first run
+func loadSessionKeys(filename string) ([][]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		hash_key, block_key, err := generateSessionKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys := [][]byte{hash_key, block_key}
+		return keys, ioutil.WriteFile(filename, []byte(formatSessionKeys(keys)), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseSessionKeys(string(content))
+}
+
+// rotateSessionKeys adds new keys in filename, sessions signed with previous
+// keys stay valid until the next rotation
+func rotateSessionKeys(filename string) error {
+	keys, err := loadSessionKeys(filename)
+	if err != nil {
+		return err
+	}
+	hash_key, block_key, err := generateSessionKeys()
+	if err != nil {
+		return err
+	}
+	keys = append([][]byte{hash_key, block_key}, keys...)
+	if len(keys) > sessionKeysKept*2 {
+		keys = keys[:sessionKeysKept*2]
+	}
+	return ioutil.WriteFile(filename, []byte(formatSessionKeys(keys)), 0600)
+}
+
+func newSessionStore() sessions.Store {
+	keys := Session.Keys
+	if len(keys) == 0 {
+		// Sessions don't survive restarts without configured keys
+		hash_key, block_key, err := generateSessionKeys()
+		if err != nil {
+			LOG.Fatal("session keys generation failed", "error", err)
+		}
+		keys = [][]byte{hash_key, block_key}
+	}
+	store := cookiestore.New(keys...)
+	store.Options(sessions.Options{
+		Path:     BasePath + "/",
+		MaxAge:   Session.MaxAge,
+		Secure:   Session.Secure,
+		HTTPOnly: true,
+	})
+	return store
+}
+
+// SameSiteMiddleware adds SameSite attribute to session cookie, it must be
+// used before sessions middleware so it runs after session is saved
+func SameSiteMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if Session.SameSite != "" {
+		same_site := "SameSite=" + strings.Title(strings.ToLower(Session.SameSite))
+		rw.(negroni.ResponseWriter).Before(func(w negroni.ResponseWriter) {
+			cookies := w.Header()["Set-Cookie"]
+			for i, cookie := range cookies {
+				if strings.HasPrefix(cookie, Session.Name+"=") && !strings.Contains(cookie, "SameSite=") {
+					cookies[i] = cookie + "; " + same_site
+				}
+			}
+		})
+	}
+	next(rw, r)
+}
+
+func isValidSameSite(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "lax", "strict", "none":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,862 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/extemporalgenome/slug"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage stores bookmarks, tags and authentication data. Methods return
+// not found errors for missing rows.
+type Storage interface {
+	Close() error
+	Ping() error
+	Stats() sql.DBStats
+	// Url is the database url given to migrate
+	Url() string
+
+	CountLinks(tags string) (int, error)
+	CountTags() (int, error)
+	// InsertLink and ImportLink return the id of the new link, ImportLink
+	// keeps createdate of imported bookmarks. Links are saved with their
+	// tags in one transaction.
+	InsertLink(title string, url string, tag_names []string) (int64, error)
+	ImportLink(title string, url string, createdate time.Time, tag_names []string) (int64, error)
+	UpdateLink(id int64, title string, url string, tag_names []string) error
+	DeleteLink(id int64) error
+	LinkTags(link_id int64) ([]*Tag, error)
+	LoadLinksTags(bms []*BookmarkItem) error
+	// BookmarksAfter and GetBookmarks return bookmarks without their tags.
+	// BookmarksAfter returns at most limit bookmarks with an id greater than
+	// after_id, ordered by id. GetBookmarks skips unknown ids and doesn't
+	// keep ids order.
+	BookmarksAfter(after_id int64, limit int) ([]*BookmarkItem, error)
+	// CurrentTime returns the database current local time, UpdatedBookmarks
+	// returns bookmarks, without their tags, inserted or updated at or after
+	// it
+	CurrentTime() (string, error)
+	UpdatedBookmarks(since string) ([]*BookmarkItem, error)
+	GetBookmarks(ids []int64) ([]*BookmarkItem, error)
+	GetBookmark(id int64) (*BookmarkItem, error)
+	// QueryBookmarks returns at most limit bookmarks without their tags and
+	// their cursors, see queryBookmark
+	QueryBookmarks(after *Cursor, before *Cursor, limit int, tags string) ([]*BookmarkItem, []*Cursor, error)
+	LinksYears() ([]int, error)
+
+	// InsertSavedSearch updates the query of the saved search with the same
+	// name, it returns a conflict error if another name has the same slug
+	InsertSavedSearch(name string, query string) (int64, error)
+	DeleteSavedSearch(search_slug string) error
+	GetSavedSearch(search_slug string) (*SavedSearch, error)
+	SavedSearches() ([]*SavedSearch, error)
+
+	GetSetting(name string) (string, error)
+	SetSetting(name string, value string) error
+	DeleteSetting(name string) error
+	// AdvanceSetting stores counter in name setting if it is greater than the
+	// stored one, it returns false otherwise
+	AdvanceSetting(name string, counter int64) (bool, error)
+
+	ReplaceRecoveryCodes(hashes []string) error
+	RecoveryCodes() (map[int64]string, error)
+	DeleteRecoveryCode(id int64) (bool, error)
+	CountRecoveryCodes() (int, error)
+
+	InsertWebAuthnCredential(credential *WebAuthnCredential) error
+	GetWebAuthnCredential(credential_id string) (*WebAuthnCredential, error)
+	WebAuthnCredentials() ([]*WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(id int64, sign_count uint32) error
+	DeleteWebAuthnCredential(id int64) error
+}
+
+// storageUrl returns the database url of config, <data>.db SQLite database
+// when database url isn't set
+func storageUrl(config StorageConfig) string {
+	if config.Database != "" {
+		return config.Database
+	}
+	db_filename, _ := databasesFilenames(config.Data)
+	return "sqlite3://" + db_filename
+}
+
+// storageScheme returns the scheme of database url, which names its
+// migrations directory
+func storageScheme(database_url string) string {
+	return strings.SplitN(database_url, "://", 2)[0]
+}
+
+// sqliteFilename returns the filename of a SQLite database url, ok is false
+// for other databases
+func sqliteFilename(database_url string) (filename string, ok bool) {
+	if storageScheme(database_url) != "sqlite3" {
+		return "", false
+	}
+	return strings.TrimPrefix(database_url, "sqlite3://"), true
+}
+
+// redactedUrl removes the password of database url, to log it
+func redactedUrl(database_url string) string {
+	u, err := url.Parse(database_url)
+	if err != nil || u.User == nil {
+		return database_url
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// openStorage applies pending migrations and opens database url
+func openStorage(database_url string) (Storage, error) {
+	latest, err := latestMigrationVersion(database_url)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateDatabase(database_url, latest, false, nil); err != nil {
+		return nil, err
+	}
+
+	switch storageScheme(database_url) {
+	case "sqlite3":
+		return newSqliteStorage(database_url)
+	case "postgres":
+		return newPostgresStorage(database_url)
+	}
+	return nil, fmt.Errorf("database url %q isn't supported, use sqlite3:// or postgres://", redactedUrl(database_url))
+}
+
+// sqlStorage implements Storage queries shared by SQL databases, they are
+// written with ? placeholders
+type sqlStorage struct {
+	db  *sql.DB
+	url string
+	// numbered rewrites placeholders as $1, $2... for PostgreSQL
+	numbered bool
+	// now is the SQL expression of the current local time, as stored in
+	// links updatedate
+	now string
+	// insertTag inserts a tag unless a tag with the same slug exists
+	insertTag string
+	// tx is set on storages returned by inTransaction
+	tx *sql.Tx
+}
+
+// maxVariables is the default SQLITE_MAX_VARIABLE_NUMBER, "IN (...)"
+// queries are split to stay below it
+const maxVariables = 999
+
+func sqlPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", count), ",")
+}
+
+// rebind numbers placeholders for PostgreSQL, question marks in single
+// quoted literals aren't placeholders and are kept
+func (s *sqlStorage) rebind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var rebound bytes.Buffer
+	quoted := false
+	count := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'':
+			// An escaped '' quote toggles twice
+			quoted = !quoted
+			rebound.WriteByte(c)
+		case c == '?' && !quoted:
+			count++
+			rebound.WriteString("$" + strconv.Itoa(count))
+		default:
+			rebound.WriteByte(c)
+		}
+	}
+	return rebound.String()
+}
+
+// sqlExecutor is implemented by *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStorage) executor() sqlExecutor {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// inTransaction runs f with a copy of s sending its queries in one
+// transaction, which is committed when f succeeds and rolled back otherwise
+func (s *sqlStorage) inTransaction(f func(tx_storage *sqlStorage) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	tx_storage := *s
+	tx_storage.tx = tx
+	if err := f(&tx_storage); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStorage) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.executor().Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStorage) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.executor().Query(s.rebind(query), args...)
+}
+
+func (s *sqlStorage) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.executor().QueryRow(s.rebind(query), args...)
+}
+
+// insert runs an INSERT query and returns the id of the new row
+func (s *sqlStorage) insert(query string, args ...interface{}) (id int64, err error) {
+	if s.numbered {
+		err = s.queryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// execFound runs an UPDATE or DELETE query, it returns not_found error when
+// no row is affected
+func (s *sqlStorage) execFound(not_found error, query string, args ...interface{}) error {
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return not_found
+	}
+	return nil
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStorage) Ping() error {
+	var one int
+	return s.db.QueryRow("SELECT 1").Scan(&one)
+}
+
+func (s *sqlStorage) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *sqlStorage) Url() string {
+	return s.url
+}
+
+func (s *sqlStorage) CountLinks(tags string) (count int, err error) {
+	if tags != "" {
+		err = s.queryRow(
+			`SELECT
+				COUNT(links.id)
+			FROM
+				links
+			LEFT JOIN
+				rel_links_tags
+			ON
+				rel_links_tags.link_id = links.id
+			LEFT JOIN
+				tags
+			ON
+				rel_links_tags.tag_id = tags.id
+			WHERE
+				tags.slug IN (?)`, tags).Scan(&count)
+	} else {
+		err = s.queryRow("SELECT COUNT(id) FROM links").Scan(&count)
+	}
+	return count, err
+}
+
+// CountTags counts tags used by at least one link
+func (s *sqlStorage) CountTags() (count int, err error) {
+	err = s.queryRow("SELECT COUNT(DISTINCT tag_id) FROM rel_links_tags").Scan(&count)
+	return count, err
+}
+
+func (s *sqlStorage) InsertLink(title string, url string, tag_names []string) (id int64, err error) {
+	err = s.inTransaction(func(tx_storage *sqlStorage) error {
+		id, err = tx_storage.insert("INSERT INTO links (title, url, updatedate) VALUES(?, ?, "+s.now+")", title, url)
+		if err != nil {
+			return err
+		}
+		return tx_storage.setLinkTags(id, tag_names)
+	})
+	return id, err
+}
+
+func (s *sqlStorage) ImportLink(title string, url string, createdate time.Time, tag_names []string) (id int64, err error) {
+	err = s.inTransaction(func(tx_storage *sqlStorage) error {
+		id, err = tx_storage.insert("INSERT INTO links (title, url, createdate, updatedate) VALUES(?, ?, ?, "+s.now+")", title, url, createdate)
+		if err != nil {
+			return err
+		}
+		return tx_storage.setLinkTags(id, tag_names)
+	})
+	return id, err
+}
+
+func (s *sqlStorage) UpdateLink(id int64, title string, url string, tag_names []string) error {
+	return s.inTransaction(func(tx_storage *sqlStorage) error {
+		err := tx_storage.execFound(
+			notFoundError("Link %d doesn't exist", id),
+			"UPDATE links SET title=?, url=?, updatedate="+s.now+" WHERE id=?", title, url, id,
+		)
+		if err != nil {
+			return err
+		}
+		return tx_storage.setLinkTags(id, tag_names)
+	})
+}
+
+func (s *sqlStorage) DeleteLink(id int64) error {
+	return s.inTransaction(func(tx_storage *sqlStorage) error {
+		_, err := tx_storage.exec("DELETE FROM rel_links_tags WHERE link_id=?", id)
+		if err != nil {
+			return err
+		}
+		return tx_storage.execFound(notFoundError("Link %d doesn't exist", id), "DELETE FROM links WHERE id=?", id)
+	})
+}
+
+// getOrCreateTag returns the id of the tag with the slug of tag_name, the
+// tag keeps the title it was created with
+func (s *sqlStorage) getOrCreateTag(tag_name string) (id int64, err error) {
+	tag_slug := slug.Slug(tag_name)
+	if _, err = s.exec(s.insertTag, tag_name, tag_slug); err != nil {
+		return 0, err
+	}
+	err = s.queryRow("SELECT id FROM tags WHERE slug=?", tag_slug).Scan(&id)
+	return id, err
+}
+
+// setLinkTags replaces the tags of link_id, it's called in the transaction
+// saving the link. Tag names with the same slug are linked once.
+func (s *sqlStorage) setLinkTags(link_id int64, tag_names []string) error {
+	_, err := s.exec("DELETE FROM rel_links_tags WHERE link_id=?", link_id)
+	if err != nil {
+		return err
+	}
+
+	linked := make(map[int64]bool, len(tag_names))
+	for _, tag_name := range tag_names {
+		tag_id, err := s.getOrCreateTag(tag_name)
+		if err != nil {
+			return err
+		}
+		if linked[tag_id] {
+			continue
+		}
+		linked[tag_id] = true
+		_, err = s.exec("INSERT INTO rel_links_tags (link_id, tag_id) VALUES(?, ?)", link_id, tag_id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStorage) LinkTags(link_id int64) (result []*Tag, err error) {
+	rows, err := s.query(
+		`SELECT
+			tags.id,
+			tags.title,
+			tags.slug
+		FROM
+			rel_links_tags
+		LEFT JOIN
+			tags
+		ON
+			rel_links_tags.tag_id = tags.id
+		WHERE
+			rel_links_tags.link_id=?`, link_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tag := new(Tag)
+		if err := rows.Scan(&tag.Id, &tag.Title, &tag.Slug); err != nil {
+			return nil, err
+		}
+		result = append(result, tag)
+	}
+	return result, rows.Err()
+}
+
+// scanBookmarks reads (id, title, url, createdate) rows and closes them
+func scanBookmarks(rows *sql.Rows) ([]*BookmarkItem, error) {
+	defer rows.Close()
+
+	bms := make([]*BookmarkItem, 0)
+	for rows.Next() {
+		bm := new(BookmarkItem)
+		if err := rows.Scan(&bm.Id, &bm.Title, &bm.Url, &bm.CreateDate); err != nil {
+			return nil, err
+		}
+
+		bms = append(bms, bm)
+	}
+	return bms, rows.Err()
+}
+
+// LoadLinksTags sets Tags of all bms with one query by maxVariables
+// bookmarks
+func (s *sqlStorage) LoadLinksTags(bms []*BookmarkItem) error {
+	bms_by_id := make(map[int64]*BookmarkItem, len(bms))
+	for _, bm := range bms {
+		bm.Tags = nil
+		bms_by_id[bm.Id] = bm
+	}
+
+	for start := 0; start < len(bms); start += maxVariables {
+		end := start + maxVariables
+		if end > len(bms) {
+			end = len(bms)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, bm := range bms[start:end] {
+			args = append(args, bm.Id)
+		}
+
+		rows, err := s.query(
+			`SELECT
+				rel_links_tags.link_id,
+				tags.id,
+				tags.title,
+				tags.slug
+			FROM
+				rel_links_tags
+			LEFT JOIN
+				tags
+			ON
+				rel_links_tags.tag_id = tags.id
+			WHERE
+				rel_links_tags.link_id IN (`+sqlPlaceholders(len(args))+`)`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var link_id int64
+			tag := new(Tag)
+			if err := rows.Scan(&link_id, &tag.Id, &tag.Title, &tag.Slug); err != nil {
+				rows.Close()
+				return err
+			}
+			bms_by_id[link_id].Tags = append(bms_by_id[link_id].Tags, tag)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStorage) BookmarksAfter(after_id int64, limit int) ([]*BookmarkItem, error) {
+	rows, err := s.query("SELECT id, title, url, createdate FROM links WHERE id > ? ORDER BY id LIMIT ?", after_id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanBookmarks(rows)
+}
+
+func (s *sqlStorage) CurrentTime() (now string, err error) {
+	err = s.queryRow("SELECT CAST(" + s.now + " AS TEXT)").Scan(&now)
+	return now, err
+}
+
+func (s *sqlStorage) UpdatedBookmarks(since string) ([]*BookmarkItem, error) {
+	rows, err := s.query("SELECT id, title, url, createdate FROM links WHERE updatedate >= ?", since)
+	if err != nil {
+		return nil, err
+	}
+	return scanBookmarks(rows)
+}
+
+// GetBookmarks runs one query by maxVariables ids
+func (s *sqlStorage) GetBookmarks(ids []int64) ([]*BookmarkItem, error) {
+	bms := make([]*BookmarkItem, 0, len(ids))
+	for start := 0; start < len(ids); start += maxVariables {
+		end := start + maxVariables
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+
+		rows, err := s.query(
+			"SELECT id, title, url, createdate FROM links WHERE id IN ("+sqlPlaceholders(len(args))+")",
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		found, err := scanBookmarks(rows)
+		if err != nil {
+			return nil, err
+		}
+		bms = append(bms, found...)
+	}
+	return bms, nil
+}
+
+func (s *sqlStorage) GetBookmark(id int64) (*BookmarkItem, error) {
+	bookmark_item := new(BookmarkItem)
+	err := s.queryRow("SELECT id, title, url, createdate FROM links WHERE id=?", id).Scan(
+		&bookmark_item.Id,
+		&bookmark_item.Title,
+		&bookmark_item.Url,
+		&bookmark_item.CreateDate,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("Link %d doesn't exist", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bookmark_item.Tags, err = s.LinkTags(id)
+	return bookmark_item, err
+}
+
+func (s *sqlStorage) QueryBookmarks(after *Cursor, before *Cursor, limit int, tags string) ([]*BookmarkItem, []*Cursor, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if tags != "" {
+		where = append(where,
+			`links.id IN (
+				SELECT
+					rel_links_tags.link_id
+				FROM
+					rel_links_tags
+				LEFT JOIN
+					tags
+				ON
+					rel_links_tags.tag_id = tags.id
+				WHERE
+					tags.slug IN (?)
+			)`)
+		args = append(args, tags)
+	}
+
+	order := "DESC"
+	if before != nil {
+		where = append(where, "(links.createdate > ? OR (links.createdate = ? AND links.id > ?))")
+		args = append(args, before.CreateDate, before.CreateDate, before.Id)
+		order = "ASC"
+	} else if after != nil {
+		where = append(where, "(links.createdate < ? OR (links.createdate = ? AND links.id < ?))")
+		args = append(args, after.CreateDate, after.CreateDate, after.Id)
+	}
+
+	query := `SELECT
+			links.id,
+			links.title,
+			links.url,
+			links.createdate,
+			CAST(links.createdate AS TEXT)
+		FROM
+			links`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY links.createdate %s, links.id %s LIMIT ?", order, order)
+	args = append(args, limit)
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	bms := make([]*BookmarkItem, 0, limit)
+	cursors := make([]*Cursor, 0, limit)
+	for rows.Next() {
+		bm := new(BookmarkItem)
+		cursor := new(Cursor)
+		err := rows.Scan(&bm.Id, &bm.Title, &bm.Url, &bm.CreateDate, &cursor.CreateDate)
+		if err != nil {
+			return nil, nil, err
+		}
+		cursor.Id = bm.Id
+
+		bms = append(bms, bm)
+		cursors = append(cursors, cursor)
+	}
+	return bms, cursors, rows.Err()
+}
+
+// linksYears returns distinct years of links createdate, year_expression
+// extracts it from createdate column
+func (s *sqlStorage) linksYears(year_expression string) (result []int, err error) {
+	rows, err := s.query(
+		`SELECT DISTINCT
+			` + year_expression + `
+		FROM
+			links
+		ORDER BY
+			1 DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var year int
+		if err := rows.Scan(&year); err != nil {
+			return nil, err
+		}
+		result = append(result, year)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStorage) InsertSavedSearch(name string, query string) (int64, error) {
+	search_slug := slug.Slug(name)
+	var id int64
+	var existing_name string
+	err := s.queryRow("SELECT id, name FROM saved_searches WHERE slug=?", search_slug).Scan(&id, &existing_name)
+	if err == sql.ErrNoRows {
+		return s.insert("INSERT INTO saved_searches (name, slug, query) VALUES(?, ?, ?)", name, search_slug, query)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if existing_name != name {
+		return 0, conflictError("Saved search %s already uses the %s address, choose another name", existing_name, search_slug)
+	}
+	_, err = s.exec("UPDATE saved_searches SET query=? WHERE id=?", query, id)
+	return id, err
+}
+
+func (s *sqlStorage) DeleteSavedSearch(search_slug string) error {
+	return s.execFound(
+		notFoundError("Saved search %s doesn't exist", search_slug),
+		"DELETE FROM saved_searches WHERE slug=?", search_slug,
+	)
+}
+
+func (s *sqlStorage) GetSavedSearch(search_slug string) (*SavedSearch, error) {
+	saved_search := new(SavedSearch)
+	err := s.queryRow(
+		"SELECT id, name, slug, query, createdate FROM saved_searches WHERE slug=?",
+		search_slug,
+	).Scan(
+		&saved_search.Id,
+		&saved_search.Name,
+		&saved_search.Slug,
+		&saved_search.Query,
+		&saved_search.CreateDate,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("Saved search %s doesn't exist", search_slug)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saved_search, nil
+}
+
+func (s *sqlStorage) SavedSearches() ([]*SavedSearch, error) {
+	rows, err := s.query("SELECT id, name, slug, query, createdate FROM saved_searches ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*SavedSearch, 0)
+	for rows.Next() {
+		saved_search := new(SavedSearch)
+		err := rows.Scan(
+			&saved_search.Id,
+			&saved_search.Name,
+			&saved_search.Slug,
+			&saved_search.Query,
+			&saved_search.CreateDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, saved_search)
+	}
+	return result, rows.Err()
+}
+
+// GetSetting returns a not found error if name setting isn't stored
+func (s *sqlStorage) GetSetting(name string) (value string, err error) {
+	err = s.queryRow("SELECT value FROM settings WHERE name=?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", notFoundError("Setting %s isn't stored", name)
+	}
+	return value, err
+}
+
+func (s *sqlStorage) DeleteSetting(name string) error {
+	_, err := s.exec("DELETE FROM settings WHERE name=?", name)
+	return err
+}
+
+// advanceSetting updates name setting only if it is lower than counter, then
+// runs insert_ignore, which inserts it unless it exists
+func (s *sqlStorage) advanceSetting(name string, counter int64, insert_ignore string) (bool, error) {
+	value := strconv.FormatInt(counter, 10)
+	res, err := s.exec(
+		"UPDATE settings SET value=? WHERE name=? AND CAST(value AS BIGINT) < ?",
+		value, name, counter,
+	)
+	if err != nil {
+		return false, err
+	}
+	if count, err := res.RowsAffected(); err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	res, err = s.exec(insert_ignore, name, value)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// ReplaceRecoveryCodes removes existing recovery codes and stores hashes
+func (s *sqlStorage) ReplaceRecoveryCodes(hashes []string) error {
+	return s.inTransaction(func(tx_storage *sqlStorage) error {
+		if _, err := tx_storage.exec("DELETE FROM recovery_codes"); err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if _, err := tx_storage.exec("INSERT INTO recovery_codes (hash) VALUES(?)", hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecoveryCodes returns the hashes of recovery codes by id
+func (s *sqlStorage) RecoveryCodes() (map[int64]string, error) {
+	rows, err := s.query("SELECT id, hash FROM recovery_codes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// DeleteRecoveryCode returns false if id recovery code was already deleted,
+// so a code can't be used twice by concurrent requests
+func (s *sqlStorage) DeleteRecoveryCode(id int64) (bool, error) {
+	res, err := s.exec("DELETE FROM recovery_codes WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *sqlStorage) CountRecoveryCodes() (count int, err error) {
+	err = s.queryRow("SELECT COUNT(id) FROM recovery_codes").Scan(&count)
+	return count, err
+}
+
+func (s *sqlStorage) InsertWebAuthnCredential(credential *WebAuthnCredential) (err error) {
+	credential.Id, err = s.insert(
+		"INSERT INTO webauthn_credentials (credential_id, public_key, sign_count, name) VALUES(?, ?, ?, ?)",
+		credential.CredentialId,
+		credential.PublicKey,
+		credential.SignCount,
+		credential.Name,
+	)
+	return err
+}
+
+func scanWebAuthnCredential(row interface {
+	Scan(dest ...interface{}) error
+}) (*WebAuthnCredential, error) {
+	credential := new(WebAuthnCredential)
+	err := row.Scan(
+		&credential.Id,
+		&credential.CredentialId,
+		&credential.PublicKey,
+		&credential.SignCount,
+		&credential.Name,
+		&credential.CreateDate,
+	)
+	return credential, err
+}
+
+// GetWebAuthnCredential returns a not found error if there is no credential
+// with credential_id
+func (s *sqlStorage) GetWebAuthnCredential(credential_id string) (*WebAuthnCredential, error) {
+	row := s.queryRow("SELECT id, credential_id, public_key, sign_count, name, createdate FROM webauthn_credentials WHERE credential_id=?", credential_id)
+	credential, err := scanWebAuthnCredential(row)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("Passkey doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (s *sqlStorage) WebAuthnCredentials() ([]*WebAuthnCredential, error) {
+	rows, err := s.query("SELECT id, credential_id, public_key, sign_count, name, createdate FROM webauthn_credentials ORDER BY createdate")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*WebAuthnCredential, 0)
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, credential)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStorage) UpdateWebAuthnSignCount(id int64, sign_count uint32) error {
+	_, err := s.exec("UPDATE webauthn_credentials SET sign_count=? WHERE id=?", sign_count, id)
+	return err
+}
+
+func (s *sqlStorage) DeleteWebAuthnCredential(id int64) error {
+	return s.execFound(notFoundError("Passkey %d doesn't exist", id), "DELETE FROM webauthn_credentials WHERE id=?", id)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattes/migrate/driver/postgres"
+)
+
+// postgresStorage stores data in a PostgreSQL database, which can be
+// shared by several gobookmark instances
+type postgresStorage struct {
+	*sqlStorage
+}
+
+func newPostgresStorage(database_url string) (*postgresStorage, error) {
+	db, err := sql.Open("postgres", database_url)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStorage{&sqlStorage{
+		db:        db,
+		url:       database_url,
+		numbered:  true,
+		now:       "LOCALTIMESTAMP(0)",
+		insertTag: "INSERT INTO tags (title, slug) VALUES(?, ?) ON CONFLICT (slug) DO NOTHING",
+	}}, nil
+}
+
+func (s *postgresStorage) LinksYears() ([]int, error) {
+	return s.linksYears("CAST(EXTRACT(YEAR FROM createdate) AS INTEGER)")
+}
+
+func (s *postgresStorage) SetSetting(name string, value string) error {
+	_, err := s.exec(
+		"INSERT INTO settings (name, value) VALUES(?, ?) ON CONFLICT (name) DO UPDATE SET value=EXCLUDED.value",
+		name, value,
+	)
+	return err
+}
+
+func (s *postgresStorage) AdvanceSetting(name string, counter int64) (bool, error) {
+	return s.advanceSetting(
+		name, counter,
+		"INSERT INTO settings (name, value) VALUES(?, ?) ON CONFLICT (name) DO NOTHING",
+	)
+}
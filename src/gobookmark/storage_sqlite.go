@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattes/migrate/driver/sqlite3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStorage stores data in a SQLite database file
+type sqliteStorage struct {
+	*sqlStorage
+}
+
+func newSqliteStorage(database_url string) (*sqliteStorage, error) {
+	filename, _ := sqliteFilename(database_url)
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStorage{&sqlStorage{
+		db:        db,
+		url:       database_url,
+		now:       "datetime('now','localtime')",
+		insertTag: "INSERT OR IGNORE INTO tags (title, slug) VALUES(?, ?)",
+	}}, nil
+}
+
+// createdate is stored as "YYYY-MM-DD HH:MM:SS" text
+func (s *sqliteStorage) LinksYears() ([]int, error) {
+	return s.linksYears("CAST(substr(createdate, 1, 4) AS INTEGER)")
+}
+
+func (s *sqliteStorage) SetSetting(name string, value string) error {
+	_, err := s.exec("INSERT OR REPLACE INTO settings (name, value) VALUES(?, ?)", name, value)
+	return err
+}
+
+func (s *sqliteStorage) AdvanceSetting(name string, counter int64) (bool, error) {
+	return s.advanceSetting(name, counter, "INSERT OR IGNORE INTO settings (name, value) VALUES(?, ?)")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certificateCheckInterval is the minimum duration between two checks of
+// certificate files modification
+const certificateCheckInterval = 10 * time.Second
+
+// certificateLoader serves the certificate of certFile and keyFile, files
+// are loaded again when they change, so renewed certificates are used
+// without restart
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	now      func() time.Time
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checkedAt   time.Time
+}
+
+func newCertificateLoader(cert_file string, key_file string) (*certificateLoader, error) {
+	loader := &certificateLoader{certFile: cert_file, keyFile: key_file, now: time.Now}
+	if err := loader.reload(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// filesModTime returns the latest modification time of certificate files
+func (l *certificateLoader) filesModTime() (time.Time, error) {
+	var result time.Time
+	for _, filename := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return result, err
+		}
+		if info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return result, nil
+}
+
+// reload loads certificate files, the previous certificate is kept on error
+func (l *certificateLoader) reload() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.load()
+}
+
+func (l *certificateLoader) load() error {
+	l.checkedAt = l.now()
+	mod_time, err := l.filesModTime()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.certificate = &certificate
+	l.modTime = mod_time
+	return nil
+}
+
+// GetCertificate is used as tls.Config GetCertificate
+func (l *certificateLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.now().Sub(l.checkedAt) >= certificateCheckInterval {
+		l.checkedAt = l.now()
+		mod_time, err := l.filesModTime()
+		if err == nil && !mod_time.Equal(l.modTime) {
+			if err = l.load(); err == nil {
+				LOG.Info("TLS certificate reloaded", "file", l.certFile)
+			}
+		}
+		if err != nil {
+			LOG.Error("TLS certificate reload failed, keep the previous one", "file", l.certFile, "error", err)
+		}
+	}
+	return l.certificate, nil
+}
+
+func newTlsConfig(loader *certificateLoader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.GetCertificate,
+	}
+}
+
+// HstsMiddleware asks browsers to use HTTPS only, on HTTPS responses
+func HstsMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	s := settings()
+	if r.TLS != nil && s.HstsMaxAge > 0 {
+		value := "max-age=" + strconv.Itoa(s.HstsMaxAge)
+		if s.HstsIncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		rw.Header().Set("Strict-Transport-Security", value)
+	}
+	next(rw, r)
+}
+
+// httpsRedirectHandler redirects plain HTTP requests to the HTTPS server
+// listening on https_port
+func httpsRedirectHandler(https_port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if https_port != "443" {
+			host = net.JoinHostPort(host, https_port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// listenUnix listens on socket path with mode permissions, a socket file
+// left by a previous run is removed
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is used by another process", path)
+		}
+		if !isConnectionRefused(err) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// The umask gives mode to the socket when it's created, other users
+	// can't connect before a chmod
+	umask := syscall.Umask(int(^mode & 0777))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	return listener, err
+}
+
+// isConnectionRefused returns true if err is a connection to a socket no
+// process listens on
+func isConnectionRefused(err error) bool {
+	if op_err, ok := err.(*net.OpError); ok {
+		err = op_err.Err
+	}
+	if syscall_err, ok := err.(*os.SyscallError); ok {
+		err = syscall_err.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
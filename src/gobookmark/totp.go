@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) parameters, the defaults supported by authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpIssuer = "GoBookmark"
+)
+
+const totpSecretSetting = "totp_secret"
+
+// totpLastCounterSetting stores the time step of the last accepted code, so
+// a code can't be used twice
+const totpLastCounterSetting = "totp_last_counter"
+
+const recoveryCodesCount = 10
+
+// totpNow is the TOTP clock, tests replace it
+var totpNow = time.Now
+
+func generateTotpSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="), nil
+}
+
+func decodeTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if padding := len(secret) % 8; padding != 0 {
+		secret += strings.Repeat("=", 8-padding)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+func totpCounterCode(key []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCode(key []byte, t time.Time) string {
+	return totpCounterCode(key, totpCounter(t))
+}
+
+// checkTotpCode returns the time step matching code, previous and next steps
+// are accepted to tolerate clock drift
+func checkTotpCode(key []byte, code string, t time.Time) (counter int64, ok bool) {
+	code = strings.Replace(code, " ", "", -1)
+	current := totpCounter(t)
+	for _, counter := range []int64{current, current - 1, current + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCounterCode(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpUri returns the otpauth URI encoded in the provisioning QR code
+func totpUri(secret string) string {
+	values := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.QueryEscape(totpIssuer) + "?" + values.Encode()
+}
+
+func isTotpEnabled() (bool, error) {
+	_, err := getSetting(totpSecretSetting)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Map(func(c rune) rune {
+		if c == '-' || c == ' ' {
+			return -1
+		}
+		return c
+	}, code))
+}
+
+// hashRecoveryCode returns the bcrypt hash of code, salted as the login
+// password
+func hashRecoveryCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// useRecoveryCode deletes the recovery code matching code, it returns false
+// if there is none
+func useRecoveryCode(code string) (bool, error) {
+	hashes, err := recoveryCodes()
+	if err != nil {
+		return false, err
+	}
+	code = normalizeRecoveryCode(code)
+	for id, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return deleteRecoveryCode(id)
+		}
+	}
+	return false, nil
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+	return codes, nil
+}
+
+// enableTotp stores secret and returns new recovery codes, only their hashes
+// are stored
+func enableTotp(secret string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hash, err := hashRecoveryCode(code)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := replaceRecoveryCodes(hashes); err != nil {
+		return nil, err
+	}
+	if err := setSetting(totpSecretSetting, secret); err != nil {
+		return nil, err
+	}
+	return codes, deleteSetting(totpLastCounterSetting)
+}
+
+func disableTotp() error {
+	if err := deleteSetting(totpSecretSetting); err != nil {
+		return err
+	}
+	if err := deleteSetting(totpLastCounterSetting); err != nil {
+		return err
+	}
+	return replaceRecoveryCodes(nil)
+}
+
+// checkSecondFactor accepts a TOTP code not used yet or a recovery code,
+// which is then deleted
+func checkSecondFactor(code string) (bool, error) {
+	secret, err := getSetting(totpSecretSetting)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		return false, err
+	}
+
+	if counter, ok := checkTotpCode(key, code, totpNow()); ok {
+		return advanceSetting(totpLastCounterSetting, counter)
+	}
+
+	return useRecoveryCode(code)
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os/user"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 func absPath(path string) (string, error) {
@@ -36,13 +39,24 @@ func assetFS() http.FileSystem {
 	panic("unreachable")
 }
 
-func extractPageTitle(url string) (string, error) {
-	resp, err := http.Get(url)
+func extractPageTitle(url string) (title string, err error) {
+	defer func() {
+		titleFetches.WithLabelValues(resultLabel(err)).Inc()
+	}()
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
 	}
+	req.Header.Set("User-Agent", settings().FetchUserAgent)
+	resp, err := settings().FetchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
-	checkErr(err)
+	if err != nil {
+		return "", err
+	}
 
 	re := regexp.MustCompile("<title>(.*?)</title>")
 	result := re.FindStringSubmatch(string(body))
@@ -54,9 +68,47 @@ func extractPageTitle(url string) (string, error) {
 	)
 }
 
-func checkErr(err error) {
-	if err != nil {
-		panic(err)
+// urlWithQuery returns u with values as query string and BasePath prefix,
+// u isn't modified
+func urlWithQuery(u *url.URL, values url.Values) string {
+	result := *u
+	result.Path = BasePath + result.Path
+	result.RawQuery = values.Encode()
+	return result.String()
+}
+
+func writeJson(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		requestLogger(r).Error("JSON encoding failed", "error", err)
+	}
+}
+
+// splitList returns trimmed non empty items of a comma separated list
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// requestOrigin returns scheme and host r was sent to
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeJsonError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		requestLogger(r).Error("JSON encoding failed", "error", err)
 	}
 }
 
@@ -76,3 +128,31 @@ func removeTags(search string) string {
 	re := regexp.MustCompile("(\\[.*?\\])")
 	return strings.TrimSpace(re.ReplaceAllString(search, ""))
 }
+
+var operatorRegexp = regexp.MustCompile("(?:^|\\s)(domain|year|after|before):(\\S+)")
+
+// extractOperators returns "name:value" filters (domain, year, after, before)
+// found in search
+func extractOperators(search string) map[string]string {
+	result := make(map[string]string)
+
+	for _, submatch := range operatorRegexp.FindAllStringSubmatch(search, -1) {
+		result[submatch[1]] = submatch[2]
+	}
+
+	return result
+}
+
+func removeOperators(search string) string {
+	return strings.TrimSpace(operatorRegexp.ReplaceAllString(search, ""))
+}
+
+// parseSearchDate parses "2006", "2006-01" or "2006-01-02" dates
+func parseSearchDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s is not a valid date", value)
+}
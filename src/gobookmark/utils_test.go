@@ -14,3 +14,46 @@ func TestExtractTags(t *testing.T) {
 func TestRemoveTags(t *testing.T) {
 	assert.Equal(t, removeTags("[foo][bar] extra"), "extra")
 }
+
+func TestExtractOperators(t *testing.T) {
+	operators := extractOperators("[foo] domain:example.com year:2015 extra")
+	assert.Equal(t, operators["domain"], "example.com")
+	assert.Equal(t, operators["year"], "2015")
+	assert.Equal(t, removeOperators("domain:example.com extra year:2015"), "extra")
+}
+
+func TestDetectLanguage(t *testing.T) {
+	assert.Equal(t, detectLanguage("How to write tests in Go"), "en")
+	assert.Equal(t, detectLanguage("Comment écrire des tests avec Go"), "fr")
+	assert.Equal(t, detectLanguage("Wie man Tests für die Anwendung schreibt"), "de")
+	assert.Equal(t, detectLanguage("Golang"), DefaultLanguage)
+}
+
+func TestValidateLink(t *testing.T) {
+	link, err := validateLink("  Example ", "example.com/a", " go, ,python,go,")
+	assert.Nil(t, err)
+	assert.Equal(t, link.Title, "Example")
+	assert.Equal(t, link.Url, "http://example.com/a")
+	assert.Equal(t, link.Tags, []string{"go", "python"})
+
+	link, _ = validateLink("Example", "localhost:8080/a", "")
+	assert.Equal(t, link.Url, "http://localhost:8080/a")
+	assert.Len(t, link.Tags, 0)
+
+	link, err = validateLink("", "javascript:alert(1)", "[go]")
+	assert.Equal(t, errorKind(err), ErrorValidation)
+	assert.Equal(t, link.Url, "javascript:alert(1)")
+	fields := errorFields(err)
+	assert.Equal(t, fields["title"], "Title is required")
+	assert.Equal(t, fields["url"], "URL must start with http:// or https://")
+	assert.Equal(t, fields["tags"], "Tag [go] can't contain brackets")
+
+	_, err = validateLink("Example", "JavaScript:alert(1)", "")
+	assert.Equal(t, errorFields(err)["url"], "URL must start with http:// or https://")
+	_, err = validateLink("Example", " ", "")
+	assert.Equal(t, errorFields(err)["url"], "URL is required")
+	_, err = validateLink("Example", "http://", "")
+	assert.Equal(t, errorFields(err)["url"], "URL host is missing")
+	_, err = validateLink("Example", "http://example.com", "go,!!!")
+	assert.Equal(t, errorFields(err)["tags"], "Tag !!! must contain letters or digits")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/extemporalgenome/slug"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength = 500
+	maxUrlLength   = 2048
+	maxTagLength   = 64
+)
+
+// allowedUrlSchemes excludes javascript: and data: links, index.html renders
+// urls as clickable href
+var allowedUrlSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+}
+
+// LinkInput is a link entered in forms, imported or sent to the API, once
+// normalized by validateLink
+type LinkInput struct {
+	Title string
+	Url   string
+	Tags  []string
+}
+
+// BookmarkItem returns link as a BookmarkItem, to fill edit form again
+func (link *LinkInput) BookmarkItem(id int64) BookmarkItem {
+	item := BookmarkItem{Id: id, Url: link.Url, Title: link.Title}
+	for _, tag := range link.Tags {
+		item.Tags = append(item.Tags, &Tag{Title: tag})
+	}
+	return item
+}
+
+// normalizeTags splits comma separated tags, blank and duplicated tags are
+// removed
+func normalizeTags(tags string) (result []string) {
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// isPort returns true when the opaque part of "host:port/path" urls parsed
+// without scheme starts with a port
+func isPort(opaque string) bool {
+	port := strings.SplitN(opaque, "/", 2)[0]
+	if port == "" {
+		return false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeUrl adds http:// to urls without scheme, urls with another
+// scheme are kept to be rejected by validateLink
+func normalizeUrl(raw_url string) string {
+	raw_url = strings.TrimSpace(raw_url)
+	if raw_url == "" || strings.Contains(raw_url, "://") {
+		return raw_url
+	}
+	if u, err := url.Parse(raw_url); err == nil && u.Scheme != "" && !isPort(u.Opaque) {
+		return raw_url
+	}
+	return "http://" + raw_url
+}
+
+func urlError(raw_url string) string {
+	if raw_url == "" {
+		return "URL is required"
+	}
+	if len(raw_url) > maxUrlLength {
+		return "URL is too long"
+	}
+	u, err := url.Parse(raw_url)
+	if err != nil {
+		return "URL is invalid"
+	}
+	if !allowedUrlSchemes[u.Scheme] {
+		return "URL must start with http:// or https://"
+	}
+	if u.Host == "" {
+		return "URL host is missing"
+	}
+	return ""
+}
+
+func tagsError(tags []string) string {
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return "Tag " + tag + " is too long"
+		}
+		// Brackets select tags in search syntax
+		if strings.ContainsAny(tag, "[]") {
+			return "Tag " + tag + " can't contain brackets"
+		}
+		// Tags are stored and searched by slug
+		if slug.Slug(tag) == "" {
+			return "Tag " + tag + " must contain letters or digits"
+		}
+	}
+	return ""
+}
+
+// validateLink normalizes a link and checks its fields, the returned link
+// is set on validation errors too, so forms can be filled again
+func validateLink(title string, raw_url string, tags string) (*LinkInput, error) {
+	link := &LinkInput{
+		Title: strings.TrimSpace(title),
+		Url:   normalizeUrl(raw_url),
+		Tags:  normalizeTags(tags),
+	}
+
+	fields := make(map[string]string)
+	if link.Title == "" {
+		fields["title"] = "Title is required"
+	} else if utf8.RuneCountInString(link.Title) > maxTitleLength {
+		fields["title"] = "Title is too long"
+	}
+	if message := urlError(link.Url); message != "" {
+		fields["url"] = message
+	}
+	if message := tagsError(link.Tags); message != "" {
+		fields["tags"] = message
+	}
+	if len(fields) > 0 {
+		return link, fieldsError(fields)
+	}
+	return link, nil
+}
+
+// fieldsError is a validation error with a message by form field
+func fieldsError(fields map[string]string) error {
+	var messages []string
+	for _, message := range fields {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	return &AppError{
+		Kind:    ErrorValidation,
+		Message: strings.Join(messages, ", "),
+		Fields:  fields,
+	}
+}
+
+// errorFields returns the message by form field of validation errors
+func errorFields(err error) map[string]string {
+	if e, ok := err.(*AppError); ok {
+		return e.Fields
+	}
+	return nil
+}
@@ -1,103 +1,228 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/Unknwon/paginater"
 	"github.com/arschles/go-bindata-html-template"
+	"github.com/extemporalgenome/slug"
 	"github.com/goincremental/negroni-sessions"
 	"github.com/gorilla/context"
+	"github.com/rsc/qr"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func getTemplate(r *http.Request, template_name string) *template.Template {
+func getTemplate(r *http.Request, template_name string) (*template.Template, error) {
+	// Token is created before rendering, session can't be saved once the
+	// response is written
+	csrf_token, err := csrfToken(r)
+	if err != nil {
+		return nil, err
+	}
 	funcMap := template.FuncMap{
 		"paginate_url": func(page int) string {
 			values := r.URL.Query()
-			values.Del("page")
-			values.Add("page", strconv.Itoa(page))
-			r.URL.RawQuery = values.Encode()
-			return r.URL.String()
+			values.Set("page", strconv.Itoa(page))
+			return urlWithQuery(r.URL, values)
 		},
 		"per_page_url": func(per_page int) string {
 			values := r.URL.Query()
-			values.Del("items_by_page")
-			values.Add("items_by_page", strconv.Itoa(per_page))
-			r.URL.RawQuery = values.Encode()
-			return r.URL.String()
+			values.Set("items_by_page", strconv.Itoa(per_page))
+			return urlWithQuery(r.URL, values)
+		},
+		"cursor_url": func(direction string, cursor *Cursor) string {
+			values := r.URL.Query()
+			values.Del("after")
+			values.Del("before")
+			values.Del("fragment")
+			values.Set(direction, cursor.String())
+			return urlWithQuery(r.URL, values)
+		},
+		"infinite_scroll_url": func(enabled bool) string {
+			values := r.URL.Query()
+			values.Del("scroll")
+			if enabled {
+				values.Set("scroll", "infinite")
+			}
+			return urlWithQuery(r.URL, values)
+		},
+		"refine_search_url": func(term string) string {
+			values := r.URL.Query()
+			values.Del("page")
+			values.Set("search", strings.TrimSpace(values.Get("search")+" "+term))
+			return urlWithQuery(&url.URL{Path: "/"}, values)
+		},
+		"saved_searches": querySavedSearches,
+		"csrf_token": func() string {
+			return csrf_token
 		},
 		"getContextBool": func(key string) bool {
-			return context.Get(r, key).(bool)
+			value, _ := context.Get(r, key).(bool)
+			return value
+		},
+		"remote_user": func() string {
+			return remoteUser(r)
+		},
+		"base_path": func() string {
+			return BasePath
 		},
 	}
-	t, err := template.New("mytmpl", Asset).Funcs(funcMap).ParseFiles(
+	return template.New("mytmpl", Asset).Funcs(funcMap).ParseFiles(
 		template_name,
 		"templates/layout.html",
 		"templates/includes/paginate.html",
+		"templates/includes/links.html",
 	)
-	checkErr(err)
-	return t
 }
 
-func Index(w http.ResponseWriter, r *http.Request, _ map[string]string) {
-	session := sessions.GetSession(r)
-	t := getTemplate(r, "templates/index.html")
+// renderTemplate renders template_name with data, or the error page if the
+// template can't be loaded
+func renderTemplate(w http.ResponseWriter, r *http.Request, template_name string, data interface{}) {
+	renderTemplateStatus(w, r, http.StatusOK, template_name, data)
+}
 
-	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+func renderTemplateStatus(w http.ResponseWriter, r *http.Request, status int, template_name string, data interface{}) {
+	t, err := getTemplate(r, template_name)
 	if err != nil {
-		page = 1
+		renderError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	// Errors once the response is partly written can only be logged
+	if err := t.Execute(w, data); err != nil {
+		requestLogger(r).Error("template rendering failed", "template", template_name, "error", err)
+	}
+}
+
+// maxItemsByPage bounds items_by_page parameter and setting
+const maxItemsByPage = 100
+
+// parseItemsByPage returns items_by_page query parameter, the items_by_page
+// setting when it's missing. It returns a validation error outside 1..maxItemsByPage.
+func parseItemsByPage(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("items_by_page")
+	if value == "" {
+		return settings().ItemsByPage, nil
 	}
+	items_by_page, err := strconv.Atoi(value)
+	if err != nil || items_by_page < 1 || items_by_page > maxItemsByPage {
+		return 0, validationError("items_by_page must be between 1 and %d", maxItemsByPage)
+	}
+	return items_by_page, nil
+}
 
-	items_by_page, err := strconv.Atoi(r.URL.Query().Get("items_by_page"))
+// parsePage returns page query parameter, 1 when it's missing or invalid
+func parsePage(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func Index(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	renderIndex(w, r, r.URL.Query().Get("search"), nil)
+}
+
+func renderIndex(w http.ResponseWriter, r *http.Request, search string, saved_search *SavedSearch) {
+	template_name := "templates/index.html"
+	if r.URL.Query().Get("fragment") != "" {
+		template_name = "templates/links_fragment.html"
+	}
+
+	page := parsePage(r)
+	items_by_page, err := parseItemsByPage(r)
 	if err != nil {
-		items_by_page = default_items_by_page
+		renderError(w, r, err)
+		return
 	}
 
-	total_links := countLinks("")
-	var result_total int
+	total_links, err := countLinks("")
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 
 	var bms []*BookmarkItem
-	search := r.URL.Query().Get("search")
+	var facets *SearchFacets
+	var paginate *paginater.Paginater
+	var prev_cursor, next_cursor *Cursor
 	if search != "" {
-		result_total, bms = searchBookmark(search, page, items_by_page)
+		var result_total int
+		result_total, bms, facets, err = searchBookmark(search, page, items_by_page)
+		paginate = paginater.New(result_total, items_by_page, page, 9)
 	} else {
-		bms = queryBookmark(page, items_by_page, r.URL.Query().Get("tags"))
-		result_total = countLinks(r.URL.Query().Get("tags"))
+		after, _ := parseCursor(r.URL.Query().Get("after"))
+		before, _ := parseCursor(r.URL.Query().Get("before"))
+		bms, prev_cursor, next_cursor, err = queryBookmark(after, before, items_by_page, r.URL.Query().Get("tags"))
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
 	}
 
 	data := struct {
-		Bms         []*BookmarkItem
-		Page        *paginater.Paginater
-		TotalLinks  int
-		ItemsByPage int
-		Search      string
+		Bms            []*BookmarkItem
+		Page           *paginater.Paginater
+		PrevCursor     *Cursor
+		NextCursor     *Cursor
+		InfiniteScroll bool
+		TotalLinks     int
+		ItemsByPage    int
+		Search         string
+		Facets         *SearchFacets
+		SavedSearch    *SavedSearch
 	}{
-		Bms:         bms,
-		Page:        paginater.New(result_total, items_by_page, page, 9),
-		TotalLinks:  total_links,
-		ItemsByPage: items_by_page,
-		Search:      search,
+		Bms:            bms,
+		Page:           paginate,
+		PrevCursor:     prev_cursor,
+		NextCursor:     next_cursor,
+		InfiniteScroll: r.URL.Query().Get("scroll") == "infinite",
+		TotalLinks:     total_links,
+		ItemsByPage:    items_by_page,
+		Search:         search,
+		Facets:         facets,
+		SavedSearch:    saved_search,
 	}
 
 	context.Set(r, "index_page", true)
-	if session.Get("login") != nil {
+	if isLoggedIn(r) {
 		context.Set(r, "login", true)
 	}
 
-	err = t.Execute(w, data)
+	renderTemplate(w, r, template_name, data)
 }
 
-func Edit(w http.ResponseWriter, r *http.Request, params map[string]string) {
-	session := sessions.GetSession(r)
-	t := getTemplate(r, "templates/edit.html")
+// linkId parses the id route parameter, unknown links are not found
+func linkId(params map[string]string) (int64, error) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		return 0, notFoundError("Link %s doesn't exist", params["id"])
+	}
+	return id, nil
+}
 
+func Edit(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	var bookmark_item BookmarkItem
 
 	if _, ok := params["id"]; ok {
-		id, err := strconv.ParseInt(params["id"], 10, 64)
-		checkErr(err)
-
-		bookmark_item = *getBookmark(id)
+		id, err := linkId(params)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		item, err := getBookmark(id)
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		bookmark_item = *item
 	} else {
 		url := appendHttp(r.URL.Query().Get("url"))
 		title, err := extractPageTitle(url)
@@ -113,75 +238,124 @@ func Edit(w http.ResponseWriter, r *http.Request, params map[string]string) {
 		}
 	}
 
+	renderEditForm(w, r, http.StatusOK, bookmark_item, nil)
+}
+
+// renderEditForm renders edit form filled with item, and field errors
+func renderEditForm(w http.ResponseWriter, r *http.Request, status int, item BookmarkItem, errors map[string]string) {
 	data := struct {
-		Item BookmarkItem
+		Item   BookmarkItem
+		Errors map[string]string
 	}{
-		Item: bookmark_item,
+		Item:   item,
+		Errors: errors,
 	}
-	if session.Get("login") != nil {
+	if isLoggedIn(r) {
 		context.Set(r, "login", true)
 	}
 
-	err := t.Execute(w, data)
-	checkErr(err)
+	renderTemplateStatus(w, r, status, "templates/edit.html", data)
 }
 
 func Save(w http.ResponseWriter, r *http.Request, params map[string]string) {
-	session := sessions.GetSession(r)
-	if session.Get("login") == nil {
-		http.Redirect(w, r, "../../", 303)
+	if !isLoggedIn(r) {
+		redirect(w, r, "../../", 303)
 		return
 	}
 
 	var link_id int64
 	var err error
 	if _, ok := params["id"]; ok {
-		link_id, err = strconv.ParseInt(params["id"], 10, 64)
-		checkErr(err)
-
-		updateLink(
-			link_id,
-			r.FormValue("title"),
-			appendHttp(r.FormValue("url")),
-			r.FormValue("tags"),
-		)
-	} else {
-		link_id = insertLink(
-			r.FormValue("title"),
-			appendHttp(r.FormValue("url")),
-			r.FormValue("tags"),
-		)
+		if link_id, err = linkId(params); err != nil {
+			renderError(w, r, err)
+			return
+		}
+	}
+
+	// Invalid links are shown again with their errors
+	link, err := validateLink(r.FormValue("title"), r.FormValue("url"), r.FormValue("tags"))
+	if errorKind(err) == ErrorValidation {
+		renderEditForm(w, r, http.StatusBadRequest, link.BookmarkItem(link_id), errorFields(err))
+		return
 	}
-	bookmark_item := getBookmark(link_id)
-	indexBookmarkItem(bookmark_item)
 
-	http.Redirect(w, r, "../../", 303)
+	if link_id, err = saveLink(link_id, link); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	bookmark_item, err := getBookmark(link_id)
+	if err == nil {
+		err = indexBookmarkItem(bookmark_item)
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	redirect(w, r, "../../", 303)
 }
 
-func Delete(w http.ResponseWriter, r *http.Request, params map[string]string) {
-	session := sessions.GetSession(r)
-	if session.Get("login") == nil {
-		http.Redirect(w, r, "../../", 303)
+func DeleteForm(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "../../", 303)
+		return
+	}
+
+	id, err := linkId(params)
+	if err != nil {
+		renderError(w, r, err)
 		return
 	}
+	bookmark_item, err := getBookmark(id)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	data := struct {
+		Item *BookmarkItem
+	}{
+		Item: bookmark_item,
+	}
+	context.Set(r, "login", true)
+
+	renderTemplate(w, r, "templates/delete.html", data)
+}
 
-	stmt, err := DB.Prepare("DELETE FROM links WHERE id=?")
-	checkErr(err)
+func Delete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "../../", 303)
+		return
+	}
 
-	_, err = stmt.Exec(params["id"])
-	checkErr(err)
+	id, err := linkId(params)
+	if err == nil {
+		err = deleteLink(id)
+	}
+	if err == nil {
+		err = unindexBookmarkItem(id)
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 
-	http.Redirect(w, r, "../../", 303)
+	redirect(w, r, "../../", 303)
 }
 
 func LoginForm(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if settings().AuthHeader != "" {
+		proxyLogin(w, r)
+		return
+	}
 	session := sessions.GetSession(r)
-	t := getTemplate(r, "templates/login.html")
 
 	data := struct {
 		Error string
+		Oidc  bool
 	}{
 		Error: "",
+		Oidc:  settings().OIDC != nil,
 	}
 
 	errors := session.Flashes("errors")
@@ -189,24 +363,78 @@ func LoginForm(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 		data.Error = errors[0].(string)
 	}
 
-	t.Execute(w, data)
+	renderTemplate(w, r, "templates/login.html", data)
+}
+
+// beginLoginAttempt reserves a login attempt of the request client in
+// LoginLimiter, failures need nothing more and successes must call
+// LoginLimiter.success. When the client must wait, it sets Retry-After and
+// returns the refusal message.
+func beginLoginAttempt(w http.ResponseWriter, r *http.Request) (ip string, refused string) {
+	ip = clientIP(r)
+	wait := LoginLimiter.begin(ip)
+	if wait <= 0 {
+		return ip, ""
+	}
+	retry_after := int(math.Ceil(wait.Seconds()))
+	auditLogger(r).Warn("login refused, too many failed attempts", "wait_seconds", retry_after)
+	w.Header().Set("Retry-After", strconv.Itoa(retry_after))
+	return ip, fmt.Sprintf("Too many failed attempts, retry in %d seconds", retry_after)
 }
 
 func Login(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if settings().AuthHeader != "" {
+		proxyLogin(w, r)
+		return
+	}
 	session := sessions.GetSession(r)
-	if r.FormValue("password") == Password {
+	ip, refused := beginLoginAttempt(w, r)
+	if refused != "" {
+		session.AddFlash(refused, "errors")
+		redirect(w, r, ".", 303)
+		return
+	}
+
+	if checkPassword(r.FormValue("password")) {
+		LoginLimiter.success(ip)
+		totp_enabled, err := isTotpEnabled()
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+		if totp_enabled {
+			session.Set("totp_pending", true)
+			redirect(w, r, "totp/", 303)
+			return
+		}
 		session.Set("login", true)
-		http.Redirect(w, r, "../", 303)
+		redirect(w, r, "../", 303)
 	} else {
+		auditLogger(r).Warn("failed login", "user_agent", r.UserAgent())
 		session.AddFlash("Password invalid", "errors")
-		http.Redirect(w, r, ".", 303)
+		redirect(w, r, ".", 303)
 	}
 }
 
+// authSessionKeys are the session keys of logins, including half-finished
+// second factor, passkey and OpenID Connect ones
+var authSessionKeys = []string{
+	"login",
+	"identity",
+	"totp_pending",
+	"totp_pending_secret",
+	"webauthn_challenge",
+	"oidc_state",
+	"oidc_nonce",
+	"oidc_code_verifier",
+}
+
 func Logout(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 	session := sessions.GetSession(r)
-	session.Delete("login")
-	http.Redirect(w, r, "../", 303)
+	for _, key := range authSessionKeys {
+		session.Delete(key)
+	}
+	redirect(w, r, "../", 303)
 }
 
 func FetchTitle(w http.ResponseWriter, r *http.Request, _ map[string]string) {
@@ -217,3 +445,705 @@ func FetchTitle(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 	}
 	w.Write([]byte(title))
 }
+
+func ShowSavedSearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	saved_search, err := getSavedSearch(params["slug"])
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	values := r.URL.Query()
+	values.Set("search", saved_search.Query)
+	r.URL.RawQuery = values.Encode()
+
+	renderIndex(w, r, saved_search.Query, saved_search)
+}
+
+func SaveSearch(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "/", 303)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	query := strings.TrimSpace(r.FormValue("query"))
+	if name == "" || query == "" {
+		redirect(w, r, "/", 303)
+		return
+	}
+	if _, err := insertSavedSearch(name, query); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	redirect(w, r, "/searches/"+slug.Slug(name)+"/", 303)
+}
+
+func DeleteSavedSearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "/", 303)
+		return
+	}
+
+	if err := deleteSavedSearch(params["slug"]); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	redirect(w, r, "/", 303)
+}
+
+func SavedSearchFeed(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	saved_search, err := getSavedSearch(params["slug"])
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	_, bms, _, err := searchBookmark(saved_search.Query, 1, settings().ItemsByPage)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	err = writeRss(
+		w,
+		"GoBookmark - "+saved_search.Name,
+		requestOrigin(r)+BasePath+"/searches/"+saved_search.Slug+"/",
+		bms,
+	)
+	if err != nil {
+		requestLogger(r).Error("RSS feed rendering failed", "error", err)
+	}
+}
+
+func ApiSavedSearches(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	saved_searches, err := querySavedSearches()
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	writeJson(w, r, saved_searches)
+}
+
+func ApiSavedSearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	saved_search, err := getSavedSearch(params["slug"])
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	page := parsePage(r)
+	items_by_page, err := parseItemsByPage(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	total, bms, _, err := searchBookmark(saved_search.Query, page, items_by_page)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	writeJson(w, r, struct {
+		*SavedSearch
+		Total int             `json:"total"`
+		Page  int             `json:"page"`
+		Items []*BookmarkItem `json:"items"`
+	}{
+		SavedSearch: saved_search,
+		Total:       total,
+		Page:        page,
+		Items:       bms,
+	})
+}
+
+func Reindex(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "/", 303)
+		return
+	}
+
+	goBackground(requestLogger(r), "search index rebuild", SEARCH.Rebuild)
+
+	redirect(w, r, "/", 303)
+}
+
+func ApiLinks(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	items_by_page, err := parseItemsByPage(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	after, _ := parseCursor(r.URL.Query().Get("after"))
+	before, _ := parseCursor(r.URL.Query().Get("before"))
+
+	bms, prev_cursor, next_cursor, err := queryBookmark(after, before, items_by_page, r.URL.Query().Get("tags"))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	result := struct {
+		Items []*BookmarkItem `json:"items"`
+		Prev  string          `json:"prev,omitempty"`
+		Next  string          `json:"next,omitempty"`
+	}{
+		Items: bms,
+	}
+	if prev_cursor != nil {
+		result.Prev = prev_cursor.String()
+	}
+	if next_cursor != nil {
+		result.Next = next_cursor.String()
+	}
+	writeJson(w, r, result)
+}
+
+func LoginTotpForm(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	if session.Get("totp_pending") == nil {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	data := struct {
+		Error string
+	}{
+		Error: "",
+	}
+
+	errors := session.Flashes("errors")
+	if len(errors) > 0 {
+		data.Error = errors[0].(string)
+	}
+
+	renderTemplate(w, r, "templates/login_totp.html", data)
+}
+
+func LoginTotp(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	if session.Get("totp_pending") == nil {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	ip, refused := beginLoginAttempt(w, r)
+	if refused != "" {
+		session.AddFlash(refused, "errors")
+		redirect(w, r, ".", 303)
+		return
+	}
+
+	valid, err := checkSecondFactor(r.FormValue("code"))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if valid {
+		LoginLimiter.success(ip)
+		session.Delete("totp_pending")
+		session.Set("login", true)
+		redirect(w, r, "/", 303)
+	} else {
+		auditLogger(r).Warn("failed second factor", "user_agent", r.UserAgent())
+		session.AddFlash("Code invalid", "errors")
+		redirect(w, r, ".", 303)
+	}
+}
+
+func renderTotpSettings(w http.ResponseWriter, r *http.Request, recovery_codes []string) {
+	session := sessions.GetSession(r)
+
+	data := struct {
+		Enabled           bool
+		Secret            string
+		Uri               string
+		RecoveryCodes     []string
+		RecoveryCodesLeft int
+		Error             string
+	}{
+		RecoveryCodes: recovery_codes,
+	}
+
+	var err error
+	data.Enabled, err = isTotpEnabled()
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if data.Enabled {
+		data.RecoveryCodesLeft, err = countRecoveryCodes()
+		if err != nil {
+			renderError(w, r, err)
+			return
+		}
+	} else {
+		secret, ok := session.Get("totp_pending_secret").(string)
+		if !ok {
+			secret, err = generateTotpSecret()
+			if err != nil {
+				renderError(w, r, err)
+				return
+			}
+			session.Set("totp_pending_secret", secret)
+		}
+		data.Secret = secret
+		data.Uri = totpUri(secret)
+	}
+
+	errors := session.Flashes("errors")
+	if len(errors) > 0 {
+		data.Error = errors[0].(string)
+	}
+	context.Set(r, "login", true)
+
+	renderTemplate(w, r, "templates/totp.html", data)
+}
+
+func TotpSettings(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	renderTotpSettings(w, r, nil)
+}
+
+func EnableTotp(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	if !isLoggedIn(r) {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	secret, ok := session.Get("totp_pending_secret").(string)
+	if !ok {
+		redirect(w, r, ".", 303)
+		return
+	}
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if _, ok := checkTotpCode(key, r.FormValue("code"), totpNow()); !ok {
+		session.AddFlash("Code invalid, check your authenticator clock", "errors")
+		redirect(w, r, ".", 303)
+		return
+	}
+
+	recovery_codes, err := enableTotp(secret)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	session.Delete("totp_pending_secret")
+	auditLogger(r).Info("two-factor authentication enabled")
+
+	renderTotpSettings(w, r, recovery_codes)
+}
+
+func DisableTotp(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	if !isLoggedIn(r) {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	ip, refused := beginLoginAttempt(w, r)
+	if refused != "" {
+		session.AddFlash(refused, "errors")
+		redirect(w, r, "../", 303)
+		return
+	}
+
+	valid, err := checkSecondFactor(r.FormValue("code"))
+	if err == nil && valid {
+		err = disableTotp()
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if !valid {
+		auditLogger(r).Warn("failed second factor", "user_agent", r.UserAgent())
+		session.AddFlash("Code invalid", "errors")
+		redirect(w, r, "../", 303)
+		return
+	}
+	LoginLimiter.success(ip)
+	auditLogger(r).Info("two-factor authentication disabled")
+
+	redirect(w, r, "../", 303)
+}
+
+func TotpQrCode(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	secret, ok := session.Get("totp_pending_secret").(string)
+	if !isLoggedIn(r) || !ok {
+		renderError(w, r, notFoundError("No pending two-factor authentication secret"))
+		return
+	}
+
+	code, err := qr.Encode(totpUri(secret), qr.M)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(code.PNG())
+}
+
+// webauthnTimeout is the ceremony timeout in milliseconds sent to browsers
+const webauthnTimeout = 60000
+
+type webauthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+func webauthnCredentialDescriptors() ([]webauthnCredentialDescriptor, error) {
+	credentials, err := queryWebAuthnCredentials()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]webauthnCredentialDescriptor, 0)
+	for _, credential := range credentials {
+		result = append(result, webauthnCredentialDescriptor{Type: "public-key", Id: credential.CredentialId})
+	}
+	return result, nil
+}
+
+// newWebAuthnChallenge stores a new challenge in session, it is removed by
+// popWebAuthnChallenge so each challenge is used once
+func newWebAuthnChallenge(r *http.Request) (string, error) {
+	challenge, err := generateWebAuthnChallenge()
+	if err != nil {
+		return "", err
+	}
+	sessions.GetSession(r).Set("webauthn_challenge", challenge)
+	return challenge, nil
+}
+
+func popWebAuthnChallenge(r *http.Request) string {
+	session := sessions.GetSession(r)
+	challenge, _ := session.Get("webauthn_challenge").(string)
+	session.Delete("webauthn_challenge")
+	return challenge
+}
+
+func WebAuthnSettings(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	if !isLoggedIn(r) {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	credentials, err := queryWebAuthnCredentials()
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	data := struct {
+		Credentials []*WebAuthnCredential
+		Error       string
+	}{
+		Credentials: credentials,
+	}
+
+	errors := session.Flashes("errors")
+	if len(errors) > 0 {
+		data.Error = errors[0].(string)
+	}
+	context.Set(r, "login", true)
+
+	renderTemplate(w, r, "templates/webauthn.html", data)
+}
+
+func WebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		writeJsonError(w, r, http.StatusForbidden, "Login required")
+		return
+	}
+	rp_id, _ := webauthnRelyingParty(r)
+	credentials, err := webauthnCredentialDescriptors()
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	challenge, err := newWebAuthnChallenge(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	writeJson(w, r, map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]string{
+			"id":   rp_id,
+			"name": "GoBookmark",
+		},
+		"user": map[string]string{
+			"id":          encodeBase64Url(webauthnUserId),
+			"name":        "gobookmark",
+			"displayName": "GoBookmark",
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgorithmES256},
+		},
+		"excludeCredentials": credentials,
+		"attestation":        "none",
+		"timeout":            webauthnTimeout,
+	})
+}
+
+func WebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if !isLoggedIn(r) {
+		writeJsonError(w, r, http.StatusForbidden, "Login required")
+		return
+	}
+	challenge := popWebAuthnChallenge(r)
+
+	var body struct {
+		Id                string `json:"id"`
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJsonError(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	client_data_json, err_client_data := decodeBase64Url(body.ClientDataJSON)
+	attestation_object, err_attestation := decodeBase64Url(body.AttestationObject)
+	if err_client_data != nil || err_attestation != nil {
+		writeJsonError(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	rp_id, origin := webauthnRelyingParty(r)
+	auth_data, err := verifyRegistration(rp_id, origin, challenge, client_data_json, attestation_object)
+	if err != nil {
+		auditLogger(r).Warn("passkey registration refused", "error", err)
+		writeJsonError(w, r, http.StatusBadRequest, "Passkey registration failed")
+		return
+	}
+	credential_id := encodeBase64Url(auth_data.CredentialId)
+	if body.Id != credential_id {
+		writeJsonError(w, r, http.StatusBadRequest, "Credential id doesn't match")
+		return
+	}
+	if _, err := getWebAuthnCredential(credential_id); err == nil {
+		renderError(w, r, conflictError("Passkey already registered"))
+		return
+	} else if !isNotFound(err) {
+		renderError(w, r, err)
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	err = insertWebAuthnCredential(&WebAuthnCredential{
+		CredentialId: credential_id,
+		PublicKey:    auth_data.PublicKey,
+		SignCount:    auth_data.SignCount,
+		Name:         name,
+	})
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	auditLogger(r).Info("passkey registered", "name", name)
+
+	writeJson(w, r, map[string]string{"redirect": BasePath + "/webauthn/"})
+}
+
+func DeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !isLoggedIn(r) {
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		renderError(w, r, notFoundError("Passkey %s doesn't exist", params["id"]))
+		return
+	}
+	if err := deleteWebAuthnCredential(id); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	auditLogger(r).Info("passkey deleted", "id", id)
+
+	redirect(w, r, "/webauthn/", 303)
+}
+
+func LoginWebAuthnBegin(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	credentials, err := webauthnCredentialDescriptors()
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if len(credentials) == 0 {
+		writeJsonError(w, r, http.StatusNotFound, "No passkey registered")
+		return
+	}
+	rp_id, _ := webauthnRelyingParty(r)
+	challenge, err := newWebAuthnChallenge(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	writeJson(w, r, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             rp_id,
+		"allowCredentials": credentials,
+		"userVerification": "preferred",
+		"timeout":          webauthnTimeout,
+	})
+}
+
+func LoginWebAuthnFinish(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	session := sessions.GetSession(r)
+	ip, refused := beginLoginAttempt(w, r)
+	if refused != "" {
+		writeJsonError(w, r, http.StatusTooManyRequests, refused)
+		return
+	}
+	challenge := popWebAuthnChallenge(r)
+
+	var body struct {
+		Id                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJsonError(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	client_data_json, err_client_data := decodeBase64Url(body.ClientDataJSON)
+	auth_data, err_auth_data := decodeBase64Url(body.AuthenticatorData)
+	signature, err_signature := decodeBase64Url(body.Signature)
+	if err_client_data != nil || err_auth_data != nil || err_signature != nil {
+		writeJsonError(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	var sign_count uint32
+	credential, err := getWebAuthnCredential(body.Id)
+	if err != nil && !isNotFound(err) {
+		renderError(w, r, err)
+		return
+	}
+	if err == nil {
+		rp_id, origin := webauthnRelyingParty(r)
+		sign_count, err = verifyAssertion(
+			rp_id, origin, challenge,
+			credential.PublicKey, credential.SignCount,
+			client_data_json, auth_data, signature,
+		)
+	}
+	if err != nil {
+		auditLogger(r).Warn("failed passkey login", "user_agent", r.UserAgent(), "error", err)
+		writeJsonError(w, r, http.StatusForbidden, "Passkey invalid")
+		return
+	}
+
+	LoginLimiter.success(ip)
+	if err := updateWebAuthnSignCount(credential.Id, sign_count); err != nil {
+		renderError(w, r, err)
+		return
+	}
+	session.Delete("totp_pending")
+	session.Set("login", true)
+	auditLogger(r).Info("passkey login", "name", credential.Name)
+
+	writeJson(w, r, map[string]string{"redirect": BasePath + "/"})
+}
+
+func LoginOidc(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	oidc := settings().OIDC
+	if oidc == nil {
+		renderError(w, r, notFoundError("Single sign-on isn't configured"))
+		return
+	}
+	session := sessions.GetSession(r)
+
+	tokens := make([]string, 3)
+	for i := range tokens {
+		var err error
+		if tokens[i], err = generateOidcToken(); err != nil {
+			renderError(w, r, err)
+			return
+		}
+	}
+	state, nonce, code_verifier := tokens[0], tokens[1], tokens[2]
+
+	authorization_url, err := oidc.authorizationUrl(r, state, nonce, code_verifier)
+	if err != nil {
+		requestLogger(r).Error("OIDC discovery failed", "error", err)
+		session.AddFlash("Identity provider unavailable", "errors")
+		redirect(w, r, "/login/", 303)
+		return
+	}
+	session.Set("oidc_state", state)
+	session.Set("oidc_nonce", nonce)
+	session.Set("oidc_code_verifier", code_verifier)
+
+	redirect(w, r, authorization_url, 302)
+}
+
+func LoginOidcCallback(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	oidc := settings().OIDC
+	if oidc == nil {
+		renderError(w, r, notFoundError("Single sign-on isn't configured"))
+		return
+	}
+	session := sessions.GetSession(r)
+	state, _ := session.Get("oidc_state").(string)
+	nonce, _ := session.Get("oidc_nonce").(string)
+	code_verifier, _ := session.Get("oidc_code_verifier").(string)
+	session.Delete("oidc_state")
+	session.Delete("oidc_nonce")
+	session.Delete("oidc_code_verifier")
+
+	query := r.URL.Query()
+	if state == "" || query.Get("state") != state {
+		session.AddFlash("Single sign-on session expired, retry", "errors")
+		redirect(w, r, "/login/", 303)
+		return
+	}
+	if query.Get("error") != "" {
+		auditLogger(r).Warn("OIDC login refused by identity provider", "error", query.Get("error"))
+		session.AddFlash("Single sign-on refused", "errors")
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	identity, err := oidc.exchange(r, query.Get("code"), nonce, code_verifier)
+	if err != nil {
+		auditLogger(r).Warn("failed OIDC login", "error", err)
+		session.AddFlash("Single sign-on failed", "errors")
+		redirect(w, r, "/login/", 303)
+		return
+	}
+	if !oidc.isAllowed(identity) {
+		auditLogger(r).Warn("OIDC login not allowed", "subject", identity.Subject, "name", identity.Name)
+		session.AddFlash(fmt.Sprintf("%s isn't allowed to log in", identity.Name), "errors")
+		redirect(w, r, "/login/", 303)
+		return
+	}
+
+	session.Delete("totp_pending")
+	session.Set("login", true)
+	session.Set("identity", identity.Name)
+	auditLogger(r).Info("OIDC login", "subject", identity.Subject, "name", identity.Name)
+	redirect(w, r, "/", 303)
+}
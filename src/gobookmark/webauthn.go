@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Authenticator data flags
+const (
+	webauthnUserPresent  = 0x01
+	webauthnAttestedData = 0x40
+)
+
+// COSE algorithm and key parameters of ES256 (ECDSA P-256 with SHA-256),
+// the only algorithm supported
+const (
+	coseKeyType        = 1
+	coseAlgorithm      = 3
+	coseEC2Curve       = -1
+	coseEC2X           = -2
+	coseEC2Y           = -3
+	coseKeyTypeEC2     = 2
+	coseAlgorithmES256 = -7
+	coseCurveP256      = 1
+)
+
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RpIdHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+func decodeBase64Url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+func encodeBase64Url(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func generateWebAuthnChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encodeBase64Url(b), nil
+}
+
+// webauthnRelyingParty returns the relying party id and origin expected for
+// requests served by r
+func webauthnRelyingParty(r *http.Request) (rp_id string, origin string) {
+	origin = settings().WebAuthnOrigin
+	if origin == "" {
+		origin = requestOrigin(r)
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", origin
+	}
+	rp_id = u.Host
+	if i := strings.LastIndex(rp_id, ":"); i != -1 && !strings.HasSuffix(rp_id, "]") {
+		rp_id = rp_id[:i]
+	}
+	return rp_id, origin
+}
+
+func verifyClientData(client_data_json []byte, expected_type string, challenge string, origin string) error {
+	var client_data webauthnClientData
+	if err := json.Unmarshal(client_data_json, &client_data); err != nil {
+		return err
+	}
+	if client_data.Type != expected_type {
+		return fmt.Errorf("client data type is %q instead of %q", client_data.Type, expected_type)
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(client_data.Challenge), []byte(challenge)) != 1 {
+		return errors.New("challenge doesn't match")
+	}
+	if client_data.Origin != origin {
+		return fmt.Errorf("origin is %q instead of %q", client_data.Origin, origin)
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	result := &authenticatorData{
+		RpIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if result.Flags&webauthnAttestedData == 0 {
+		return result, nil
+	}
+
+	// Attested credential data : AAGUID (16), credential id length (2),
+	// credential id, COSE public key
+	data = data[37:]
+	if len(data) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	id_length := int(binary.BigEndian.Uint16(data[16:18]))
+	data = data[18:]
+	if len(data) < id_length {
+		return nil, errors.New("credential id is truncated")
+	}
+	result.CredentialId = data[:id_length]
+
+	cose_key, _, err := cborDecode(data[id_length:])
+	if err != nil {
+		return nil, err
+	}
+	result.PublicKey, err = parseCoseKey(cose_key)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseCoseKey returns ES256 COSE key as an uncompressed P-256 point
+func parseCoseKey(cose_key interface{}) ([]byte, error) {
+	key, ok := cose_key.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key isn't a map")
+	}
+	if key[int64(coseKeyType)] != int64(coseKeyTypeEC2) ||
+		key[int64(coseAlgorithm)] != int64(coseAlgorithmES256) ||
+		key[int64(coseEC2Curve)] != int64(coseCurveP256) {
+		return nil, errors.New("only ES256 keys are supported")
+	}
+	x, ok_x := key[int64(coseEC2X)].([]byte)
+	y, ok_y := key[int64(coseEC2Y)].([]byte)
+	if !ok_x || !ok_y || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("COSE key coordinates are invalid")
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)) {
+		return nil, errors.New("COSE key isn't on P-256 curve")
+	}
+	return elliptic.Marshal(curve, new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)), nil
+}
+
+func checkRpIdHash(auth_data *authenticatorData, rp_id string) error {
+	rp_id_hash := sha256.Sum256([]byte(rp_id))
+	if subtle.ConstantTimeCompare(auth_data.RpIdHash, rp_id_hash[:]) != 1 {
+		return errors.New("relying party id doesn't match")
+	}
+	if auth_data.Flags&webauthnUserPresent == 0 {
+		return errors.New("user presence flag isn't set")
+	}
+	return nil
+}
+
+// verifyRegistration checks a navigator.credentials.create() response,
+// attestation statement isn't verified ("none" attestation conveyance)
+func verifyRegistration(rp_id string, origin string, challenge string, client_data_json []byte, attestation_object []byte) (*authenticatorData, error) {
+	err := verifyClientData(client_data_json, "webauthn.create", challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := cborDecode(attestation_object)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("attestation object isn't a map")
+	}
+	raw_auth_data, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object authData is missing")
+	}
+
+	auth_data, err := parseAuthenticatorData(raw_auth_data)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRpIdHash(auth_data, rp_id); err != nil {
+		return nil, err
+	}
+	if auth_data.PublicKey == nil {
+		return nil, errors.New("attested credential data is missing")
+	}
+	return auth_data, nil
+}
+
+// verifyAssertion checks a navigator.credentials.get() response signed by
+// public_key and returns the new signature counter
+func verifyAssertion(rp_id string, origin string, challenge string, public_key []byte, sign_count uint32, client_data_json []byte, raw_auth_data []byte, signature []byte) (uint32, error) {
+	err := verifyClientData(client_data_json, "webauthn.get", challenge, origin)
+	if err != nil {
+		return 0, err
+	}
+
+	auth_data, err := parseAuthenticatorData(raw_auth_data)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkRpIdHash(auth_data, rp_id); err != nil {
+		return 0, err
+	}
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, public_key)
+	if x == nil {
+		return 0, errors.New("stored public key is invalid")
+	}
+	var ecdsa_signature struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(signature, &ecdsa_signature); err != nil {
+		return 0, err
+	}
+	client_data_hash := sha256.Sum256(client_data_json)
+	signed := sha256.Sum256(append(append([]byte{}, raw_auth_data...), client_data_hash[:]...))
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, signed[:], ecdsa_signature.R, ecdsa_signature.S) {
+		return 0, errors.New("signature is invalid")
+	}
+
+	// A counter which doesn't increase reveals a cloned authenticator,
+	// authenticators without counter always send 0
+	if (auth_data.SignCount != 0 || sign_count != 0) && auth_data.SignCount <= sign_count {
+		return 0, errors.New("signature counter didn't increase")
+	}
+	return auth_data.SignCount, nil
+}
+
+// webauthnUserId identifies the only user of the instance
+var webauthnUserId = bytes.Repeat([]byte{1}, 16)